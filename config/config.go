@@ -1,16 +1,341 @@
 package config
 
-type Interface struct {
-	PublicKey  string
-	PrivateKey string
+import (
+	"bufio"
+	"com.github.grambbledook/simple_vpn/protocol"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config mirrors the wg-quick configuration file:
+// a single [Interface] section followed by any number of [Peer] sections.
+type Config struct {
+	Interface Interface
+	Peers     []Peer
 }
 
-type Network struct {
-	port int
+// Interface holds the local settings. The public key is always derived from PrivateKey,
+// a PublicKey entry is only accepted for compatibility and must match the derived key.
+type Interface struct {
+	PrivateKey protocol.PrivateKey
+	ListenPort uint16
+	Address    []netip.Prefix
+	DNS        []netip.Addr
+	DNSSearch  []string
+	MTU        int
+	FwMark     uint32
+	Table      string
+	PreUp      []string
+	PostUp     []string
+	PreDown    []string
+	PostDown   []string
+
+	publicKey protocol.PublicKey
 }
 
 type Peer struct {
-	PublicKey  string
-	AllowedIps []string
-	Endpoint   string
+	PublicKey           protocol.PublicKey
+	PresharedKey        protocol.PresharedKey
+	AllowedIPs          []netip.Prefix
+	Endpoint            string
+	PersistentKeepalive time.Duration
+}
+
+// Error points to the line of the configuration file which failed to parse.
+type Error struct {
+	Line    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+func errorf(line int, format string, args ...any) error {
+	return &Error{Line: line, Message: fmt.Sprintf(format, args...)}
+}
+
+const (
+	sectionNone = iota
+	sectionInterface
+	sectionPeer
+)
+
+func Load(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return Parse(file)
+}
+
+func Parse(reader io.Reader) (*Config, error) {
+	var cfg Config
+
+	section := sectionNone
+	interfaceLine := 0
+	publicKeyLine := 0
+	var peer *Peer
+	peerLines := make(map[protocol.PublicKey]int)
+	peerLine := 0
+
+	finishPeer := func() error {
+		if peer == nil {
+			return nil
+		}
+		if peer.PublicKey == (protocol.PublicKey{}) {
+			return errorf(peerLine, "peer section is missing PublicKey")
+		}
+		if line, ok := peerLines[peer.PublicKey]; ok {
+			return errorf(peerLine, "peer with the same PublicKey is already defined on line %d", line)
+		}
+		peerLines[peer.PublicKey] = peerLine
+		cfg.Peers = append(cfg.Peers, *peer)
+		peer = nil
+		return nil
+	}
+
+	scanner := bufio.NewScanner(reader)
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		if strings.HasPrefix(text, "[") {
+			if err := finishPeer(); err != nil {
+				return nil, err
+			}
+
+			switch strings.ToLower(text) {
+			case "[interface]":
+				if interfaceLine != 0 {
+					return nil, errorf(line, "duplicate [Interface] section, first defined on line %d", interfaceLine)
+				}
+				section = sectionInterface
+				interfaceLine = line
+			case "[peer]":
+				section = sectionPeer
+				peer = &Peer{}
+				peerLine = line
+			default:
+				return nil, errorf(line, "unknown section %s", text)
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, errorf(line, "expected key = value")
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if value == "" {
+			return nil, errorf(line, "empty value for %s", key)
+		}
+
+		var err error
+		switch section {
+		case sectionInterface:
+			if strings.EqualFold(key, "PublicKey") {
+				publicKeyLine = line
+			}
+			err = parseInterfaceKey(&cfg.Interface, key, value)
+		case sectionPeer:
+			err = parsePeerKey(peer, key, value)
+		default:
+			err = fmt.Errorf("%s is outside of any section", key)
+		}
+		if err != nil {
+			return nil, errorf(line, "%s", err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := finishPeer(); err != nil {
+		return nil, err
+	}
+
+	if interfaceLine == 0 {
+		return nil, errorf(line, "missing [Interface] section")
+	}
+	if cfg.Interface.PrivateKey == (protocol.PrivateKey{}) {
+		return nil, errorf(interfaceLine, "interface section is missing PrivateKey")
+	}
+	if derived := cfg.Interface.PrivateKey.PublicKey(); publicKeyLine != 0 && cfg.Interface.publicKey != derived {
+		return nil, errorf(publicKeyLine, "PublicKey doesn't match PrivateKey, expected %s", derived.ToBase64())
+	}
+
+	return &cfg, nil
+}
+
+func parseInterfaceKey(iface *Interface, key, value string) error {
+	var err error
+
+	switch strings.ToLower(key) {
+	case "privatekey":
+		err = iface.PrivateKey.FromBase64(value)
+	case "publickey":
+		err = iface.publicKey.FromBase64(value)
+	case "listenport":
+		iface.ListenPort, err = parsePort(value)
+	case "address":
+		for _, item := range splitList(value) {
+			prefix, err := parseAddress(item)
+			if err != nil {
+				return err
+			}
+			iface.Address = append(iface.Address, prefix)
+		}
+	case "dns":
+		for _, item := range splitList(value) {
+			if addr, err := netip.ParseAddr(item); err == nil {
+				iface.DNS = append(iface.DNS, addr)
+			} else {
+				iface.DNSSearch = append(iface.DNSSearch, item)
+			}
+		}
+	case "mtu":
+		iface.MTU, err = strconv.Atoi(value)
+		if err == nil && (iface.MTU < 576 || iface.MTU > 65535) {
+			err = fmt.Errorf("MTU %d is out of range", iface.MTU)
+		}
+	case "fwmark":
+		iface.FwMark, err = parseFwMark(value)
+	case "table":
+		iface.Table, err = parseTable(value)
+	case "preup":
+		iface.PreUp = append(iface.PreUp, value)
+	case "postup":
+		iface.PostUp = append(iface.PostUp, value)
+	case "predown":
+		iface.PreDown = append(iface.PreDown, value)
+	case "postdown":
+		iface.PostDown = append(iface.PostDown, value)
+	default:
+		return fmt.Errorf("unknown interface key %s", key)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return nil
+}
+
+func parsePeerKey(peer *Peer, key, value string) error {
+	var err error
+
+	switch strings.ToLower(key) {
+	case "publickey":
+		err = peer.PublicKey.FromBase64(value)
+	case "privatekey":
+		return fmt.Errorf("peer sections must not contain a PrivateKey, only the peer itself may know it")
+	case "presharedkey":
+		err = peer.PresharedKey.FromBase64(value)
+	case "allowedips":
+		for _, item := range splitList(value) {
+			prefix, err := netip.ParsePrefix(item)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", key, err)
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, prefix.Masked())
+		}
+	case "endpoint":
+		err = validateEndpoint(value)
+		peer.Endpoint = value
+	case "persistentkeepalive":
+		peer.PersistentKeepalive, err = parseKeepalive(value)
+	default:
+		return fmt.Errorf("unknown peer key %s", key)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	items := strings.Split(value, ",")
+	result := items[:0]
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func parsePort(value string) (uint16, error) {
+	port, err := strconv.ParseUint(value, 10, 16)
+	return uint16(port), err
+}
+
+// parseAddress accepts both plain addresses and prefixes,
+// a plain address is treated as a host prefix.
+func parseAddress(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		return netip.ParsePrefix(value)
+	}
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func parseFwMark(value string) (uint32, error) {
+	if strings.EqualFold(value, "off") {
+		return 0, nil
+	}
+	mark, err := strconv.ParseUint(value, 0, 32)
+	return uint32(mark), err
+}
+
+func parseTable(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case "off", "auto":
+		return strings.ToLower(value), nil
+	}
+	if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+		return "", fmt.Errorf("expected off, auto or a table number")
+	}
+	return value, nil
+}
+
+func parseKeepalive(value string) (time.Duration, error) {
+	if strings.EqualFold(value, "off") {
+		return 0, nil
+	}
+	seconds, err := strconv.ParseUint(value, 10, 16)
+	return time.Duration(seconds) * time.Second, err
+}
+
+func validateEndpoint(value string) error {
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("missing host")
+	}
+	_, err = parsePort(port)
+	return err
 }
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"com.github.grambbledook/simple_vpn/protocol"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+const fullConfig = `
+# Server configuration
+[Interface]
+PrivateKey = WEGlnZqW7a3J+AmKoDg+/L95sSIutu9ApEp3AY+l30o=
+PublicKey = pMo33VR8Lwi0nmi3sAFTFttomPI71LSMkEjFXws94wU=
+ListenPort = 51820
+Address = 10.0.0.1/24, fd00::1/64
+Address = 10.0.1.1
+DNS = 1.1.1.1, 2606:4700:4700::1111, example.internal
+MTU = 1420
+FwMark = 0x1234
+Table = off
+PreUp = echo pre-up
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+PostUp = echo second
+PreDown = echo pre-down
+PostDown = iptables -D FORWARD -i %i -j ACCEPT
+
+[Peer]
+PublicKey = doQkpj/AjVrfbTFENyj46kzYWNDdrXulSfxBdnmslCo=
+PresharedKey = FpCyhws9cxwWoV4xELtfJvjJN+zQVRPISllRWgeopVE=
+AllowedIPs = 10.0.0.2/32, 192.168.1.7/24
+Endpoint = 192.95.5.6:41414
+PersistentKeepalive = 25
+
+[peer]
+publickey = pMo33VR8Lwi0nmi3sAFTFttomPI71LSMkEjFXws94wU= # keys are case insensitive
+AllowedIPs = ::/0
+Endpoint = vpn.example.com:51820
+`
+
+func Test_Parse_FullConfig(t *testing.T) {
+	cfg, err := Parse(strings.NewReader(fullConfig))
+	assert.Nil(t, err)
+
+	iface := cfg.Interface
+	assert.Equal(t, protocol.SkFromString("WEGlnZqW7a3J+AmKoDg+/L95sSIutu9ApEp3AY+l30o="), iface.PrivateKey)
+	assert.Equal(t, uint16(51820), iface.ListenPort)
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.1/24"),
+		netip.MustParsePrefix("fd00::1/64"),
+		netip.MustParsePrefix("10.0.1.1/32"),
+	}, iface.Address)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("2606:4700:4700::1111")}, iface.DNS)
+	assert.Equal(t, []string{"example.internal"}, iface.DNSSearch)
+	assert.Equal(t, 1420, iface.MTU)
+	assert.Equal(t, uint32(0x1234), iface.FwMark)
+	assert.Equal(t, "off", iface.Table)
+	assert.Equal(t, []string{"echo pre-up"}, iface.PreUp)
+	assert.Equal(t, []string{"iptables -A FORWARD -i %i -j ACCEPT", "echo second"}, iface.PostUp)
+	assert.Equal(t, []string{"echo pre-down"}, iface.PreDown)
+	assert.Equal(t, []string{"iptables -D FORWARD -i %i -j ACCEPT"}, iface.PostDown)
+
+	assert.Len(t, cfg.Peers, 2)
+
+	first := cfg.Peers[0]
+	assert.Equal(t, protocol.PkFromString("doQkpj/AjVrfbTFENyj46kzYWNDdrXulSfxBdnmslCo="), first.PublicKey)
+	assert.NotEqual(t, protocol.PresharedKey{}, first.PresharedKey)
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.2/32"),
+		netip.MustParsePrefix("192.168.1.0/24"),
+	}, first.AllowedIPs)
+	assert.Equal(t, "192.95.5.6:41414", first.Endpoint)
+	assert.Equal(t, 25*time.Second, first.PersistentKeepalive)
+
+	second := cfg.Peers[1]
+	assert.Equal(t, protocol.PkFromString("pMo33VR8Lwi0nmi3sAFTFttomPI71LSMkEjFXws94wU="), second.PublicKey)
+	assert.Equal(t, protocol.PresharedKey{}, second.PresharedKey)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("::/0")}, second.AllowedIPs)
+	assert.Equal(t, "vpn.example.com:51820", second.Endpoint)
+	assert.Zero(t, second.PersistentKeepalive)
+}
+
+func Test_Parse_RepositoryConfig(t *testing.T) {
+	cfg, err := Load("../config.conf")
+	assert.Nil(t, err)
+	assert.Len(t, cfg.Peers, 1)
+	assert.Equal(t, uint16(21841), cfg.Interface.ListenPort)
+}
+
+func Test_Parse_Errors(t *testing.T) {
+	const key = "WEGlnZqW7a3J+AmKoDg+/L95sSIutu9ApEp3AY+l30o="
+
+	tests := []struct {
+		name   string
+		config string
+		line   int
+	}{
+		{"missing interface", "[Peer]\nPublicKey = " + key, 2},
+		{"missing private key", "[Interface]\nListenPort = 1", 1},
+		{"duplicate interface", "[Interface]\nPrivateKey = " + key + "\n[Interface]", 3},
+		{"unknown section", "[Interface]\nPrivateKey = " + key + "\n[Server]", 3},
+		{"key outside section", "PrivateKey = " + key, 1},
+		{"missing separator", "[Interface]\nPrivateKey", 2},
+		{"empty value", "[Interface]\nPrivateKey =", 2},
+		{"unknown interface key", "[Interface]\nPrivateKey = " + key + "\nColour = blue", 3},
+		{"unknown peer key", "[Interface]\nPrivateKey = " + key + "\n[Peer]\nPublicKey = " + key + "\nColour = blue", 5},
+		{"invalid key", "[Interface]\nPrivateKey = not-a-key", 2},
+		{"short key", "[Interface]\nPrivateKey = AAAA", 2},
+		{"invalid port", "[Interface]\nPrivateKey = " + key + "\nListenPort = 70000", 3},
+		{"invalid address", "[Interface]\nPrivateKey = " + key + "\nAddress = 10.0.0.300/24", 3},
+		{"invalid mtu", "[Interface]\nPrivateKey = " + key + "\nMTU = 100", 3},
+		{"invalid table", "[Interface]\nPrivateKey = " + key + "\nTable = main", 3},
+		{"invalid fwmark", "[Interface]\nPrivateKey = " + key + "\nFwMark = mark", 3},
+		{"peer without public key", "[Interface]\nPrivateKey = " + key + "\n\n[Peer]\nAllowedIPs = 0.0.0.0/0", 4},
+		{"duplicate peer", "[Interface]\nPrivateKey = " + key + "\n[Peer]\nPublicKey = " + key + "\n[Peer]\nPublicKey = " + key, 5},
+		{"invalid allowed ips", "[Interface]\nPrivateKey = " + key + "\n[Peer]\nPublicKey = " + key + "\nAllowedIPs = 10.0.0.0/33", 5},
+		{"invalid endpoint", "[Interface]\nPrivateKey = " + key + "\n[Peer]\nPublicKey = " + key + "\nEndpoint = 10.0.0.1", 5},
+		{"peer private key", "[Interface]\nPrivateKey = " + key + "\n[Peer]\nPublicKey = " + key + "\nPrivateKey = " + key, 5},
+		{"mismatched public key", "[Interface]\nPrivateKey = " + key + "\nPublicKey = doQkpj/AjVrfbTFENyj46kzYWNDdrXulSfxBdnmslCo=", 3},
+		{"invalid keepalive", "[Interface]\nPrivateKey = " + key + "\n[Peer]\nPublicKey = " + key + "\nPersistentKeepalive = forever", 5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(test.config))
+
+			var cfgErr *Error
+			if assert.True(t, errors.As(err, &cfgErr), "unexpected error %v", err) {
+				assert.Equal(t, test.line, cfgErr.Line, cfgErr.Error())
+			}
+		})
+	}
+}
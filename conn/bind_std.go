@@ -0,0 +1,383 @@
+package conn
+
+import (
+	"errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+	"net/netip"
+	"runtime"
+	"sync"
+	"syscall"
+)
+
+// maxIPv6PayloadLen bounds the size of a coalesced datagram.
+const maxIPv6PayloadLen = MaxSegmentSize - 8
+
+// batchReader and batchWriter are implemented by both ipv4.PacketConn and ipv6.PacketConn,
+// and their messages have the same type.
+type batchReader interface {
+	ReadBatch([]ipv6.Message, int) (int, error)
+}
+
+type batchWriter interface {
+	WriteBatch([]ipv6.Message, int) (int, error)
+}
+
+// StdNetBind is a Bind over a pair of IPv4 and IPv6 sockets bound to the same port.
+// On Linux the datagrams are read and written with recvmmsg and sendmmsg,
+// and coalesced with UDP GSO and GRO when the kernel supports them.
+// Elsewhere a single datagram is read or written per syscall.
+type StdNetBind struct {
+	mu   sync.Mutex
+	ipv4 *net.UDPConn
+	ipv6 *net.UDPConn
+
+	ipv4PC *ipv4.PacketConn
+	ipv6PC *ipv6.PacketConn
+
+	ipv4TxOffload, ipv4RxOffload bool
+	ipv6TxOffload, ipv6RxOffload bool
+
+	msgs sync.Pool
+}
+
+func NewStdNetBind() Bind {
+	return &StdNetBind{
+		msgs: sync.Pool{
+			New: func() any {
+				msgs := make([]ipv6.Message, IdealBatchSize)
+				for i := range msgs {
+					msgs[i].Buffers = make(net.Buffers, 1)
+					msgs[i].OOB = make([]byte, 0, controlSize)
+				}
+				return &msgs
+			},
+		},
+	}
+}
+
+func listenNet(network string, port int) (*net.UDPConn, int, error) {
+	conn, err := net.ListenUDP(network, &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, 0, err
+	}
+	return conn, conn.LocalAddr().(*net.UDPAddr).Port, nil
+}
+
+// listenBoth opens the IPv4 and IPv6 sockets, either of them may be missing
+// if the address family isn't supported. A random port picked for IPv4
+// may be taken for IPv6, in which case another one is tried.
+func listenBoth(port int) (v4, v6 *net.UDPConn, actual int, err error) {
+	for tries := 0; ; tries++ {
+		v4, actual, err = listenNet("udp4", port)
+		if err != nil && !errors.Is(err, syscall.EAFNOSUPPORT) {
+			return nil, nil, 0, err
+		}
+		if v4 == nil {
+			actual = port
+		}
+
+		var port6 int
+		v6, port6, err = listenNet("udp6", actual)
+		if err == nil {
+			return v4, v6, port6, nil
+		}
+
+		if v4 != nil {
+			if port == 0 && errors.Is(err, syscall.EADDRINUSE) && tries < 100 {
+				v4.Close()
+				continue
+			}
+			if errors.Is(err, syscall.EAFNOSUPPORT) {
+				return v4, nil, actual, nil
+			}
+			v4.Close()
+		}
+		return nil, nil, 0, err
+	}
+}
+
+func (s *StdNetBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ipv4 != nil || s.ipv6 != nil {
+		return nil, 0, ErrBindAlreadyOpen
+	}
+
+	v4, v6, actual, err := listenBoth(int(port))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var fns []ReceiveFunc
+	if v4 != nil {
+		s.ipv4 = v4
+		s.ipv4PC = ipv4.NewPacketConn(v4)
+		s.ipv4TxOffload, s.ipv4RxOffload = supportsUDPOffload(v4)
+		fns = append(fns, s.receiveFunc(s.ipv4PC, v4, s.ipv4RxOffload))
+	}
+	if v6 != nil {
+		s.ipv6 = v6
+		s.ipv6PC = ipv6.NewPacketConn(v6)
+		s.ipv6TxOffload, s.ipv6RxOffload = supportsUDPOffload(v6)
+		fns = append(fns, s.receiveFunc(s.ipv6PC, v6, s.ipv6RxOffload))
+	}
+	return fns, uint16(actual), nil
+}
+
+func (s *StdNetBind) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err1, err2 error
+	if s.ipv4 != nil {
+		err1 = s.ipv4.Close()
+	}
+	if s.ipv6 != nil {
+		err2 = s.ipv6.Close()
+	}
+	s.ipv4, s.ipv4PC = nil, nil
+	s.ipv6, s.ipv6PC = nil, nil
+	s.ipv4TxOffload, s.ipv4RxOffload = false, false
+	s.ipv6TxOffload, s.ipv6RxOffload = false, false
+
+	return errors.Join(err1, err2)
+}
+
+func (s *StdNetBind) SetMark(mark uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, conn := range []*net.UDPConn{s.ipv4, s.ipv6} {
+		if conn == nil {
+			continue
+		}
+		if err := setMark(conn, mark); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *StdNetBind) BatchSize() int {
+	if runtime.GOOS == "linux" {
+		return IdealBatchSize
+	}
+	return 1
+}
+
+func (s *StdNetBind) getMessages() *[]ipv6.Message {
+	return s.msgs.Get().(*[]ipv6.Message)
+}
+
+func (s *StdNetBind) putMessages(msgs *[]ipv6.Message) {
+	for i := range *msgs {
+		(*msgs)[i].Buffers[0] = nil
+		(*msgs)[i] = ipv6.Message{Buffers: (*msgs)[i].Buffers, OOB: (*msgs)[i].OOB[:0]}
+	}
+	s.msgs.Put(msgs)
+}
+
+func (s *StdNetBind) receiveFunc(br batchReader, conn *net.UDPConn, rxOffload bool) ReceiveFunc {
+	return func(bufs [][]byte, sizes []int, eps []netip.AddrPort) (int, error) {
+		msgs := s.getMessages()
+		defer s.putMessages(msgs)
+
+		batch := (*msgs)[:min(len(bufs), len(*msgs))]
+		for i := range batch {
+			batch[i].Buffers[0] = bufs[i]
+			batch[i].OOB = batch[i].OOB[:cap(batch[i].OOB)]
+		}
+
+		var (
+			n   int
+			err error
+		)
+		switch {
+		case runtime.GOOS != "linux":
+			msg := &batch[0]
+			var addr *net.UDPAddr
+			msg.N, msg.NN, _, addr, err = conn.ReadMsgUDP(msg.Buffers[0], msg.OOB)
+			msg.Addr = addr
+			n = 1
+		case rxOffload && len(batch) > udpSegmentMaxDatagrams:
+			// Coalesced datagrams are read into the last buffers and split into the preceding ones
+			readAt := len(batch) - len(batch)/udpSegmentMaxDatagrams
+			if _, err = br.ReadBatch(batch[readAt:], 0); err == nil {
+				n, err = splitCoalescedMessages(batch, readAt, getGSOSize)
+			}
+		default:
+			n, err = br.ReadBatch(batch, 0)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		for i := 0; i < n; i++ {
+			sizes[i] = batch[i].N
+			if sizes[i] == 0 {
+				continue
+			}
+			addr := batch[i].Addr.(*net.UDPAddr).AddrPort()
+			eps[i] = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+		}
+		return n, nil
+	}
+}
+
+func (s *StdNetBind) Send(bufs [][]byte, ep netip.AddrPort) error {
+	s.mu.Lock()
+	is6 := ep.Addr().Is6() && !ep.Addr().Is4In6()
+	conn, bw, offload := s.ipv4, batchWriter(s.ipv4PC), s.ipv4TxOffload
+	if is6 {
+		conn, bw, offload = s.ipv6, s.ipv6PC, s.ipv6TxOffload
+	}
+	s.mu.Unlock()
+
+	if conn == nil {
+		return syscall.EAFNOSUPPORT
+	}
+
+	msgs := s.getMessages()
+	defer s.putMessages(msgs)
+
+	addr := net.UDPAddrFromAddrPort(netip.AddrPortFrom(ep.Addr().Unmap(), ep.Port()))
+	if offload && len(bufs) <= len(*msgs) {
+		n := coalesceMessages(addr, bufs, *msgs, setGSOSize)
+		err := send(conn, bw, (*msgs)[:n])
+		if err == nil || !errShouldDisableUDPGSO(err) {
+			return err
+		}
+
+		s.mu.Lock()
+		if is6 {
+			s.ipv6TxOffload = false
+		} else {
+			s.ipv4TxOffload = false
+		}
+		s.mu.Unlock()
+	}
+
+	for i := 0; i < len(bufs); {
+		batch := (*msgs)[:min(len(bufs)-i, len(*msgs))]
+		for j := range batch {
+			batch[j].Buffers[0] = bufs[i+j]
+			batch[j].Addr = addr
+			batch[j].OOB = batch[j].OOB[:0]
+		}
+		if err := send(conn, bw, batch); err != nil {
+			return err
+		}
+		i += len(batch)
+	}
+	return nil
+}
+
+func send(conn *net.UDPConn, bw batchWriter, msgs []ipv6.Message) error {
+	if runtime.GOOS != "linux" {
+		for _, msg := range msgs {
+			if _, _, err := conn.WriteMsgUDP(msg.Buffers[0], msg.OOB, msg.Addr.(*net.UDPAddr)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for start := 0; start < len(msgs); {
+		n, err := bw.WriteBatch(msgs[start:], 0)
+		if err != nil {
+			return err
+		}
+		start += n
+	}
+	return nil
+}
+
+type getGSOFunc func(control []byte) (int, error)
+
+type setGSOFunc func(control *[]byte, size uint16)
+
+// coalesceMessages appends consecutive datagrams of the same size to the first one of the run,
+// so the kernel segments them again. Only the last datagram of a run may be shorter.
+// It returns the number of messages to send.
+func coalesceMessages(addr *net.UDPAddr, bufs [][]byte, msgs []ipv6.Message, setGSO setGSOFunc) int {
+	var (
+		base    = -1
+		size    int
+		count   int
+		endsRun bool
+	)
+
+	for _, buf := range bufs {
+		if base >= 0 {
+			coalesced := msgs[base].Buffers[0]
+			if len(coalesced)+len(buf) <= maxIPv6PayloadLen &&
+				len(buf) <= size &&
+				len(buf) <= cap(coalesced)-len(coalesced) &&
+				count < udpSegmentMaxDatagrams &&
+				!endsRun {
+				msgs[base].Buffers[0] = append(coalesced, buf...)
+				count++
+				endsRun = len(buf) < size
+				continue
+			}
+
+			if count > 1 {
+				setGSO(&msgs[base].OOB, uint16(size))
+			}
+		}
+
+		base++
+		msgs[base].Buffers[0] = buf
+		msgs[base].Addr = addr
+		msgs[base].OOB = msgs[base].OOB[:0]
+		size = len(buf)
+		count = 1
+		endsRun = false
+	}
+
+	if count > 1 {
+		setGSO(&msgs[base].OOB, uint16(size))
+	}
+	return base + 1
+}
+
+// splitCoalescedMessages splits the datagrams read from msgs[firstMsgAt:] into segments,
+// copying them into the buffers of msgs from the start. It returns the number of segments.
+func splitCoalescedMessages(msgs []ipv6.Message, firstMsgAt int, getGSO getGSOFunc) (n int, err error) {
+	for i := firstMsgAt; i < len(msgs); i++ {
+		msg := &msgs[i]
+		if msg.N == 0 {
+			return n, nil
+		}
+
+		size, err := getGSO(msg.OOB[:msg.NN])
+		if err != nil {
+			return n, err
+		}
+
+		// The message itself may receive the last segment, so its length is read once
+		total := msg.N
+		if size == 0 {
+			size = total
+		}
+
+		for start := 0; start < total; start += size {
+			if n > i {
+				return n, errors.New("coalesced datagram doesn't fit into the buffers")
+			}
+			end := min(start+size, total)
+
+			msgs[n].N = copy(msgs[n].Buffers[0], msg.Buffers[0][start:end])
+			msgs[n].Addr = msg.Addr
+			n++
+		}
+
+		if i != n-1 {
+			msg.N = 0
+		}
+	}
+	return n, nil
+}
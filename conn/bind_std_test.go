@@ -0,0 +1,160 @@
+package conn
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/ipv6"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func datagrams(count, size int) [][]byte {
+	bufs := make([][]byte, count)
+	for i := range bufs {
+		// Spare capacity allows the datagrams to be coalesced
+		bufs[i] = make([]byte, size, MaxSegmentSize)
+		for j := range bufs[i] {
+			bufs[i][j] = byte(i)
+		}
+	}
+	return bufs
+}
+
+func receiveAll(t *testing.T, fns []ReceiveFunc, count int) ([][]byte, []netip.AddrPort) {
+	bufs := make([][]byte, IdealBatchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, MaxSegmentSize)
+	}
+	sizes := make([]int, IdealBatchSize)
+	eps := make([]netip.AddrPort, IdealBatchSize)
+
+	var (
+		received [][]byte
+		sources  []netip.AddrPort
+	)
+	for len(received) < count {
+		n, err := fns[0](bufs, sizes, eps)
+		if !assert.Nil(t, err) {
+			return received, sources
+		}
+		for i := 0; i < n; i++ {
+			if sizes[i] == 0 {
+				continue
+			}
+			received = append(received, bytes.Clone(bufs[i][:sizes[i]]))
+			sources = append(sources, eps[i])
+		}
+	}
+	return received, sources
+}
+
+func Test_StdNetBind_SendReceive(t *testing.T) {
+	sender := NewStdNetBind()
+	_, senderPort, err := sender.Open(0)
+	assert.Nil(t, err)
+	defer sender.Close()
+
+	receiver := NewStdNetBind()
+	fns, receiverPort, err := receiver.Open(0)
+	assert.Nil(t, err)
+	defer receiver.Close()
+
+	// A run of equally sized datagrams ending with a shorter one
+	bufs := append(datagrams(10, 1200), datagrams(1, 100)...)
+	assert.Nil(t, sender.Send(bufs, netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), receiverPort)))
+
+	received, sources := receiveAll(t, fns, len(bufs))
+	assert.Len(t, received, len(bufs))
+	for i := range received {
+		assert.Equal(t, bufs[i], received[i])
+		assert.Equal(t, netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), senderPort), sources[i])
+	}
+}
+
+func Test_StdNetBind_OpenClose(t *testing.T) {
+	bind := NewStdNetBind()
+	fns, port, err := bind.Open(0)
+	assert.Nil(t, err)
+	assert.NotZero(t, port)
+	assert.NotEmpty(t, fns)
+
+	_, _, err = bind.Open(0)
+	assert.ErrorIs(t, err, ErrBindAlreadyOpen)
+
+	assert.Nil(t, bind.Close())
+	_, err = fns[0](make([][]byte, 1), make([]int, 1), make([]netip.AddrPort, 1))
+	assert.ErrorIs(t, err, net.ErrClosed)
+
+	err = bind.Send([][]byte{{1}}, netip.MustParseAddrPort("127.0.0.1:1"))
+	assert.NotNil(t, err, "a closed bind can't send")
+
+	// The port is free once the bind is closed
+	_, reopened, err := bind.Open(port)
+	assert.Nil(t, err)
+	assert.Equal(t, port, reopened)
+	assert.Nil(t, bind.Close())
+}
+
+func newMessages(count, size int) []ipv6.Message {
+	msgs := make([]ipv6.Message, count)
+	for i := range msgs {
+		msgs[i].Buffers = net.Buffers{make([]byte, size)}
+		msgs[i].OOB = make([]byte, 0, 8)
+	}
+	return msgs
+}
+
+func Test_CoalesceAndSplitMessages(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 51820}
+	bufs := append(datagrams(3, 100), datagrams(2, 50)...)
+	bufs = append(bufs, datagrams(1, 200)...)
+
+	var segmentSizes []uint16
+	setGSO := func(control *[]byte, size uint16) {
+		segmentSizes = append(segmentSizes, size)
+		*control = append(*control, byte(size))
+	}
+
+	msgs := newMessages(len(bufs), 0)
+	n := coalesceMessages(addr, bufs, msgs, setGSO)
+
+	// 100+100+100+50 | 50 | 200, a shorter datagram ends the run
+	assert.Equal(t, 3, n)
+	assert.Equal(t, []uint16{100}, segmentSizes)
+	assert.Len(t, msgs[0].Buffers[0], 350)
+	assert.Len(t, msgs[1].Buffers[0], 50)
+	assert.Len(t, msgs[2].Buffers[0], 200)
+
+	// The coalesced datagram is read into the last buffer and split from the first one
+	read := newMessages(6, 400)
+	read[5].N = copy(read[5].Buffers[0], msgs[0].Buffers[0])
+	read[5].NN = 1
+	read[5].OOB = append(read[5].OOB, 100)
+	read[5].Addr = addr
+	getGSO := func(control []byte) (int, error) {
+		if len(control) == 0 {
+			return 0, nil
+		}
+		return int(control[0]), nil
+	}
+
+	n, err := splitCoalescedMessages(read, 5, getGSO)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	for i, size := range []int{100, 100, 100, 50} {
+		assert.Equal(t, size, read[i].N)
+		assert.Equal(t, bufs[i], read[i].Buffers[0][:read[i].N])
+		assert.Equal(t, addr, read[i].Addr)
+	}
+	assert.Zero(t, read[5].N)
+
+	// Segments which don't fit into the preceding buffers are an error
+	overflow := newMessages(2, 400)
+	overflow[1].N = 300
+	overflow[1].NN = 1
+	overflow[1].OOB = append(overflow[1].OOB, 100)
+
+	_, err = splitCoalescedMessages(overflow, 1, getGSO)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,43 @@
+// Package conn abstracts the UDP sockets of the device,
+// reading and writing datagrams in batches to reduce the per-packet syscall overhead.
+package conn
+
+import (
+	"errors"
+	"net/netip"
+)
+
+const (
+	// IdealBatchSize is the number of datagrams read or written with a single syscall.
+	IdealBatchSize = 128
+
+	// MaxSegmentSize is the largest UDP payload. Receive buffers should be this large,
+	// as segments coalesced by the kernel are read into a single buffer before they are split.
+	MaxSegmentSize = (1 << 16) - 1
+)
+
+// ReceiveFunc reads up to len(bufs) datagrams, storing the size and the source
+// of the i-th datagram in sizes[i] and eps[i]. A zero size marks an empty slot.
+// sizes and eps must be at least as long as bufs.
+type ReceiveFunc func(bufs [][]byte, sizes []int, eps []netip.AddrPort) (n int, err error)
+
+// Bind is the UDP transport of the device.
+type Bind interface {
+	// Open listens on the port, picking a random one if it is 0, and returns
+	// a ReceiveFunc for each socket, which fails with net.ErrClosed once the Bind is closed.
+	Open(port uint16) (fns []ReceiveFunc, actualPort uint16, err error)
+
+	Close() error
+
+	// SetMark sets the firewall mark of the outgoing datagrams.
+	SetMark(mark uint32) error
+
+	// Send writes the datagrams to the endpoint. It may append to the buffers
+	// within their capacity to coalesce datagrams of the same size.
+	Send(bufs [][]byte, ep netip.AddrPort) error
+
+	// BatchSize is the number of buffers ReceiveFunc should be called with.
+	BatchSize() int
+}
+
+var ErrBindAlreadyOpen = errors.New("bind is already open")
@@ -0,0 +1,77 @@
+package conn
+
+import (
+	"encoding/binary"
+	"errors"
+	"golang.org/x/sys/unix"
+	"net"
+	"unsafe"
+)
+
+const (
+	sizeOfGSOData = 2
+
+	// udpSegmentMaxDatagrams is the number of segments the kernel coalesces at most.
+	udpSegmentMaxDatagrams = 64
+)
+
+// controlSize is the space for the UDP_SEGMENT and UDP_GRO control messages.
+var controlSize = unix.CmsgSpace(sizeOfGSOData)
+
+// supportsUDPOffload enables UDP GRO on the socket and reports whether
+// the kernel can segment (UDP_SEGMENT) and coalesce (UDP_GRO) datagrams.
+func supportsUDPOffload(conn *net.UDPConn) (txOffload, rxOffload bool) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return false, false
+	}
+
+	err = raw.Control(func(fd uintptr) {
+		_, errTx := unix.GetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_SEGMENT)
+		txOffload = errTx == nil
+		rxOffload = unix.SetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_GRO, 1) == nil
+	})
+	if err != nil {
+		return false, false
+	}
+	return txOffload, rxOffload
+}
+
+// getGSOSize reads the segment size of a coalesced datagram, 0 means the datagram wasn't coalesced.
+func getGSOSize(control []byte) (int, error) {
+	rest := control
+	for len(rest) > unix.SizeofCmsghdr {
+		hdr, data, remainder, err := unix.ParseOneSocketControlMessage(rest)
+		if err != nil {
+			return 0, err
+		}
+		if hdr.Level == unix.SOL_UDP && hdr.Type == unix.UDP_GRO && len(data) >= sizeOfGSOData {
+			return int(binary.NativeEndian.Uint16(data)), nil
+		}
+		rest = remainder
+	}
+	return 0, nil
+}
+
+// setGSOSize appends a UDP_SEGMENT control message, so the kernel splits the datagram into segments of the size.
+func setGSOSize(control *[]byte, size uint16) {
+	length := len(*control)
+	space := unix.CmsgSpace(sizeOfGSOData)
+	if cap(*control)-length < space {
+		return
+	}
+
+	*control = (*control)[:length+space]
+	cmsg := (*control)[length:]
+	hdr := (*unix.Cmsghdr)(unsafe.Pointer(&cmsg[0]))
+	hdr.Level = unix.SOL_UDP
+	hdr.Type = unix.UDP_SEGMENT
+	hdr.SetLen(unix.CmsgLen(sizeOfGSOData))
+	binary.NativeEndian.PutUint16(cmsg[unix.CmsgLen(0):], size)
+}
+
+// errShouldDisableUDPGSO reports whether a send failed because the device can't offload
+// the checksums of the segments, in which case the datagrams are sent one by one.
+func errShouldDisableUDPGSO(err error) bool {
+	return errors.Is(err, unix.EIO)
+}
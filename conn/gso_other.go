@@ -0,0 +1,23 @@
+//go:build !linux
+
+package conn
+
+import "net"
+
+const udpSegmentMaxDatagrams = 1
+
+var controlSize = 0
+
+func supportsUDPOffload(conn *net.UDPConn) (txOffload, rxOffload bool) {
+	return false, false
+}
+
+func getGSOSize(control []byte) (int, error) {
+	return 0, nil
+}
+
+func setGSOSize(control *[]byte, size uint16) {}
+
+func errShouldDisableUDPGSO(err error) bool {
+	return false
+}
@@ -0,0 +1,23 @@
+package conn
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+)
+
+// setMark sets SO_MARK on the socket, so the policy routing could tell tunnel traffic apart.
+func setMark(conn *net.UDPConn, mark uint32) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(mark))
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
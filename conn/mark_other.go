@@ -0,0 +1,15 @@
+//go:build !linux
+
+package conn
+
+import (
+	"errors"
+	"net"
+)
+
+func setMark(conn *net.UDPConn, mark uint32) error {
+	if mark != 0 {
+		return errors.New("fwmark is only supported on Linux")
+	}
+	return nil
+}
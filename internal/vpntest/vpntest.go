@@ -0,0 +1,100 @@
+// Package vpntest provides the fixtures shared by the tests which need a working tunnel:
+// devices with a session established between them, forwarding packets between their TUN devices.
+package vpntest
+
+import (
+	"com.github.grambbledook/simple_vpn/protocol"
+	"com.github.grambbledook/simple_vpn/tun"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"net/netip"
+	"testing"
+)
+
+// IPv4Packet builds an inner packet with the payload, only the header fields read by the tunnel are set.
+func IPv4Packet(src, dst netip.Addr, payload string) []byte {
+	packet := make([]byte, protocol.IPv4HeaderSize+len(payload))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	copy(packet[12:16], src.AsSlice())
+	copy(packet[16:20], dst.AsSlice())
+	copy(packet[protocol.IPv4HeaderSize:], payload)
+	return packet
+}
+
+// NewPeers creates two devices which are each other's peer,
+// routing the prefix of each device to it.
+func NewPeers(alicePrefix, bobPrefix netip.Prefix) (*protocol.Device, *protocol.Device) {
+	alice := protocol.NewDevice(protocol.NewPrivateKey())
+	bob := protocol.NewDevice(protocol.NewPrivateKey())
+
+	toBob := alice.AddPeer(protocol.Peer{PublicKey: bob.Local.PublicKey})
+	alice.AllowedIPs.Insert(bobPrefix, toBob)
+	toAlice := bob.AddPeer(protocol.Peer{PublicKey: alice.Local.PublicKey})
+	bob.AllowedIPs.Insert(alicePrefix, toAlice)
+
+	return alice, bob
+}
+
+// Handshake establishes a session between the devices, so both of them can send transport messages.
+func Handshake(t testing.TB, initiator, responder *protocol.Device) {
+	toResponder := initiator.LookupPeer(responder.Local.PublicKey)
+	toInitiator := responder.LookupPeer(initiator.Local.PublicKey)
+
+	toResponder.Lock()
+	ih, err := toResponder.InitiateHandshake()
+	toResponder.Unlock()
+	assert.Nil(t, err)
+	_, err = responder.ProcessInitiateHandshakeMessage(ih, netip.AddrPort{})
+	assert.Nil(t, err)
+
+	toInitiator.Lock()
+	rh, err := toInitiator.CreateInitiateHandshakeResponse()
+	assert.Nil(t, err)
+	assert.Nil(t, toInitiator.BeginSymmetricSession())
+	toInitiator.Unlock()
+
+	_, err = initiator.ProcessInitiateHandshakeResponseMessage(rh, netip.AddrPort{})
+	assert.Nil(t, err)
+	toResponder.Lock()
+	assert.Nil(t, toResponder.BeginSymmetricSession())
+	toResponder.Unlock()
+}
+
+// Link hands the datagrams sent by one pipeline to the other one, like a network between them.
+func Link(from, to *protocol.Pipeline) {
+	from.OnSend = func(_ *protocol.Tunnel, datagrams [][]byte) error {
+		for _, datagram := range datagrams {
+			buffer := to.Buffers.Get()
+			n := copy(buffer[:], datagram)
+			if err := to.Decrypt(buffer, n, netip.AddrPort{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Forward starts the pipeline with a forwarder between it and the TUN device.
+// The forwarder returns once the TUN device is closed, the pipeline is stopped when the test ends.
+func Forward(t testing.TB, pipeline *protocol.Pipeline, tunDevice tun.Device) {
+	forwarder := &tun.Forwarder{Device: tunDevice, Pipeline: pipeline}
+	pipeline.OnReceive = forwarder.Receive
+
+	pipeline.Start()
+	t.Cleanup(pipeline.Stop)
+	go forwarder.Run()
+}
+
+// Connect establishes a session between the devices and forwards the packets between their TUN devices.
+func Connect(t testing.TB, alice, bob *protocol.Device, aliceTun, bobTun tun.Device) {
+	Handshake(t, alice, bob)
+
+	alicePipeline := &protocol.Pipeline{Device: alice}
+	bobPipeline := &protocol.Pipeline{Device: bob}
+	Link(alicePipeline, bobPipeline)
+	Link(bobPipeline, alicePipeline)
+
+	Forward(t, alicePipeline, aliceTun)
+	Forward(t, bobPipeline, bobTun)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"com.github.grambbledook/simple_vpn/protocol"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// keyCommands are the subcommands producing keys in the same format as the wg tool.
+var keyCommands = map[string]func(stdin io.Reader, stdout io.Writer) error{
+	"genkey": genKey,
+	"pubkey": pubKey,
+	"genpsk": genPSK,
+}
+
+func genKey(_ io.Reader, stdout io.Writer) error {
+	sk := protocol.NewPrivateKey()
+	_, err := fmt.Fprintln(stdout, sk.ToBase64())
+	return err
+}
+
+// pubKey reads a private key from stdin and prints the matching public key.
+func pubKey(stdin io.Reader, stdout io.Writer) error {
+	input, err := io.ReadAll(io.LimitReader(stdin, 1024))
+	if err != nil {
+		return err
+	}
+
+	var sk protocol.PrivateKey
+	if err := sk.FromBase64(strings.TrimSpace(string(input))); err != nil {
+		return errors.New("key is not the correct length or format")
+	}
+
+	_, err = fmt.Fprintln(stdout, sk.PublicKey().ToBase64())
+	return err
+}
+
+func genPSK(_ io.Reader, stdout io.Writer) error {
+	_, err := fmt.Fprintln(stdout, protocol.NewPresharedKey().ToBase64())
+	return err
+}
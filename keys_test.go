@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"com.github.grambbledook/simple_vpn/protocol"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func Test_KeyCommands(t *testing.T) {
+	var sk, pk, psk bytes.Buffer
+
+	assert.Nil(t, keyCommands["genkey"](nil, &sk))
+	assert.Nil(t, keyCommands["pubkey"](strings.NewReader(sk.String()), &pk))
+	assert.Nil(t, keyCommands["genpsk"](nil, &psk))
+
+	for _, output := range []string{sk.String(), pk.String(), psk.String()} {
+		assert.Len(t, output, 45, "base64 of 32 bytes followed by a newline")
+		assert.True(t, strings.HasSuffix(output, "=\n"))
+	}
+
+	private := protocol.SkFromString(strings.TrimSpace(sk.String()))
+	assert.Equal(t, private.PublicKey(), protocol.PkFromString(strings.TrimSpace(pk.String())))
+}
+
+func Test_KeyCommands_PubKeyMatchesWg(t *testing.T) {
+	var pk bytes.Buffer
+
+	// Key pair produced by wg genkey | wg pubkey
+	assert.Nil(t, keyCommands["pubkey"](strings.NewReader("WEGlnZqW7a3J+AmKoDg+/L95sSIutu9ApEp3AY+l30o=\n"), &pk))
+	assert.Equal(t, "pMo33VR8Lwi0nmi3sAFTFttomPI71LSMkEjFXws94wU=\n", pk.String())
+
+	assert.NotNil(t, keyCommands["pubkey"](strings.NewReader("not a key"), &pk))
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func Test_NewLogger(t *testing.T) {
+	var text, structured bytes.Buffer
+
+	logger, err := newLogger(&text, "text", "warn")
+	assert.Nil(t, err)
+	logger.Info("hidden")
+	logger.Warn("shown", "peer", "abcd")
+	assert.Equal(t, 1, strings.Count(text.String(), "\n"))
+	assert.Contains(t, text.String(), `msg=shown peer=abcd`)
+
+	logger, err = newLogger(&structured, "json", "debug")
+	assert.Nil(t, err)
+	logger.Debug("shown")
+	var record map[string]any
+	assert.Nil(t, json.Unmarshal(structured.Bytes(), &record))
+	assert.Equal(t, "shown", record["msg"])
+
+	_, err = newLogger(&text, "xml", "info")
+	assert.NotNil(t, err)
+	_, err = newLogger(&text, "text", "verbose")
+	assert.NotNil(t, err)
+}
@@ -1,13 +1,31 @@
 package main
 
 import (
+	"com.github.grambbledook/simple_vpn/config"
+	"com.github.grambbledook/simple_vpn/conn"
+	"com.github.grambbledook/simple_vpn/metrics"
 	"com.github.grambbledook/simple_vpn/protocol"
-	"encoding/base64"
+	"com.github.grambbledook/simple_vpn/state"
+	"com.github.grambbledook/simple_vpn/tun"
+	"com.github.grambbledook/simple_vpn/tun/netstack"
+	"com.github.grambbledook/simple_vpn/uapi"
+	"com.github.grambbledook/simple_vpn/vpn"
+	"flag"
 	"fmt"
-	"gopkg.in/ini.v1"
 	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// defaultMTU leaves room for the outer IPv6 and UDP headers and the transport header on a 1500 bytes link.
+const defaultMTU = 1420
+
 func Must[T any](t T, err error) T {
 	if err != nil {
 		panic(err)
@@ -15,113 +33,158 @@ func Must[T any](t T, err error) T {
 	return t
 }
 
-func PublicKey(key string) (pub protocol.PublicKey) {
-	if err := pub.FromBase64(key); err != nil {
-		panic(err)
+func main() {
+	if len(os.Args) > 1 {
+		if command, ok := keyCommands[os.Args[1]]; ok {
+			if err := command(os.Stdin, os.Stdout); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
 	}
-	return
-}
 
-func PrivateKey(key string) (priv protocol.PrivateKey) {
-	if err := priv.FromBase64(key); err != nil {
-		panic(err)
+	configPath := flag.String("config", "config.conf", "path to the configuration file")
+	client := flag.Bool("client", false, "initiate handshakes with the peers having an Endpoint")
+	iface := flag.String("interface", "", "name of the TUN device and the control socket, the configuration file name by default")
+	statePath := flag.String("state", "", "path to the handshake state file, <interface>.state next to the configuration by default")
+	logFormat := flag.String("log-format", "text", "format of the log records written to stderr, text or json")
+	logLevel := flag.String("log-level", "info", "minimum level of the logged records, debug, info, warn or error")
+	useNetstack := flag.Bool("netstack", false, "forward the packets through a userspace network stack instead of a TUN device, which requires CAP_NET_ADMIN")
+	metricsAddr := flag.String("metrics", "", "listen address of the Prometheus /metrics endpoint, disabled by default")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] | genkey | pubkey | genpsk\n", os.Args[0])
+		flag.PrintDefaults()
 	}
-	return
-}
+	flag.Parse()
 
-func main() {
-	cfg := Must(ini.Load("config.conf"))
-
-	devicePublicKey := cfg.Section("Interface").Key("PublicKey")
-	devicePrivateKey := cfg.Section("Interface").Key("PrivateKey")
-	clientPrivateKey := cfg.Section("Peer").Key("PrivateKey")
-	clientPublicKey := cfg.Section("Peer").Key("PublicKey")
-
-	tunnel := protocol.Tunnel{
-		Local: protocol.Peer{
-			PublicKey:  PublicKey(devicePublicKey.String()),
-			PrivateKey: PrivateKey(devicePrivateKey.String()),
-		},
-		Remote: protocol.Peer{
-			PublicKey:  PublicKey(clientPublicKey.String()),
-			PrivateKey: PrivateKey(clientPrivateKey.String()),
-		},
-		Handshake: protocol.Handshake{},
-	}
-	tunnel.Initialise()
-
-	fmt.Println("host sk 0:", devicePrivateKey.String())
-	fmt.Println("host sk 1:", base64.StdEncoding.EncodeToString(tunnel.Local.PrivateKey[:]))
-
-	fmt.Println("host pk 0:", devicePublicKey.String())
-	fmt.Println("host pk 1:", base64.StdEncoding.EncodeToString(tunnel.Local.PublicKey[:]))
-	ppk := tunnel.Local.PrivateKey.PublicKey()
-	fmt.Println("host pk 2:", base64.StdEncoding.EncodeToString(ppk[:]))
-
-	fmt.Println("client sk 0:", clientPrivateKey.String())
-	fmt.Println("client sk 1:", base64.StdEncoding.EncodeToString(tunnel.Remote.PrivateKey[:]))
-
-	fmt.Println("client pk 0:", clientPublicKey.String())
-	fmt.Println("client pk 1:", base64.StdEncoding.EncodeToString(tunnel.Remote.PublicKey[:]))
-	cpk := tunnel.Remote.PrivateKey.PublicKey()
-	fmt.Println("client pk 2:", base64.StdEncoding.EncodeToString(cpk[:]))
-
-	listenPort := Must(cfg.Section("Interface").Key("ListenPort").Int())
-	fmt.Println("Interface params:\n",
-		"  PORT", listenPort, "\n",
-		"  SK", base64.StdEncoding.EncodeToString(tunnel.Local.PrivateKey[:]), "\n",
-		"  PK", base64.StdEncoding.EncodeToString(tunnel.Local.PublicKey[:]), "\n",
-	)
-	fmt.Println("Peer params:\n",
-		"  SK", base64.StdEncoding.EncodeToString(tunnel.Remote.PrivateKey[:]), "\n",
-		"  PK", base64.StdEncoding.EncodeToString(tunnel.Remote.PublicKey[:]), "\n",
-	)
-
-	host := net.UDPAddr{
-		IP:   net.IPv4(0, 0, 0, 0),
-		Port: listenPort,
-	}
-	fmt.Println("UDPAddr", host)
-
-	bind := Must(net.ListenUDP("udp", &host))
-	defer bind.Close()
-
-	fmt.Println("Listening on", bind.LocalAddr())
-
-	buffer := make([]byte, 1024)
-	for {
-
-		n, remoteAddr, err := bind.ReadFromUDP(buffer)
-		if err != nil {
-			fmt.Println("Error reading from UDP", err)
-			continue
+	if *iface == "" {
+		*iface = strings.TrimSuffix(filepath.Base(*configPath), filepath.Ext(*configPath))
+	}
+	if *statePath == "" {
+		*statePath = filepath.Join(filepath.Dir(*configPath), *iface+".state")
+	}
+
+	logger, err := newLogger(os.Stderr, *logFormat, *logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	cfg := Must(config.Load(*configPath))
+
+	device := protocol.NewDevice(cfg.Interface.PrivateKey)
+	// The logger must be set before the peers are added, as they derive their loggers from it
+	device.Logger = logger
+	// Timestamps must be loaded before the peers are added
+	timestamps, err := state.Open(*statePath)
+	if err != nil {
+		logger.Error("failed to load the handshake state", "path", *statePath, "error", err)
+		os.Exit(1)
+	}
+	timestamps.OnError = func(err error) {
+		logger.Warn("failed to save the handshake state", "path", *statePath, "error", err)
+	}
+	defer func() {
+		if err := timestamps.Close(); err != nil {
+			timestamps.OnError(err)
 		}
-		fmt.Println("Received", n, "bytes from", remoteAddr)
+	}()
+	device.Timestamps = timestamps
 
-		if buffer[0] == protocol.HandshakeInitType {
+	vpnInterface := &vpn.Interface{Device: device, Bind: conn.NewStdNetBind()}
 
-			var message protocol.MessageHandshakeInit
-			if err := message.FromBytes(buffer[:n]); err != nil {
-				fmt.Println("  Can't parse a message of type [HandshakeInit]", err)
-				continue
-			}
+	keepalives := make(map[protocol.PublicKey]time.Duration)
+	for _, peer := range cfg.Peers {
+		keepalives[peer.PublicKey] = peer.PersistentKeepalive
+	}
+	device.OnPeerAdded = func(tunnel *protocol.Tunnel) {
+		tunnel.Timers.PersistentKeepaliveInterval = keepalives[tunnel.Remote.PublicKey]
+		vpnInterface.SetupPeer(tunnel)
+	}
 
-			fmt.Println("  Type", message.Type, "Sender", message.Sender, "ephemeral", message.Ephemeral, "static", message.Static, "ts", message.Timestamp)
+	for _, peer := range cfg.Peers {
+		tunnel := device.AddPeer(protocol.Peer{
+			PublicKey:    peer.PublicKey,
+			PresharedKey: peer.PresharedKey,
+		})
+
+		if peer.Endpoint != "" {
+			endpoint := Must(net.ResolveUDPAddr("udp", peer.Endpoint)).AddrPort()
+			tunnel.Lock()
+			tunnel.Endpoint = netip.AddrPortFrom(endpoint.Addr().Unmap(), endpoint.Port())
+			tunnel.Unlock()
+		}
 
-			if err := tunnel.ProcessInitiateHandshakeMessage(message); err != nil {
-				fmt.Println("  Error occurred on [HandshakeInit] message processing", err)
-				continue
-			}
-			response, err := tunnel.CreateInitiateHandshakeResponse()
-			if err != nil {
-				fmt.Println("  Error occurred creating Handshake response", err)
-			}
-			bytes := response.ToBytes()
-			tunnel.Stamper.Stamp(bytes)
+		for _, prefix := range peer.AllowedIPs {
+			device.AllowedIPs.Insert(prefix, tunnel)
+		}
+	}
 
-			if _, err = bind.WriteToUDP(bytes, remoteAddr); err != nil {
-				fmt.Println("  Error occurred on sending Handshake response", err)
-			}
+	mtu := cfg.Interface.MTU
+	if mtu == 0 {
+		mtu = defaultMTU
+	}
+	tunDevice, err := createTUN(*iface, mtu, cfg.Interface, *useNetstack)
+	if err != nil {
+		logger.Error("failed to create the TUN device", "name", *iface, "error", err)
+		os.Exit(1)
+	}
+	vpnInterface.TUN = tunDevice
+
+	if err := vpnInterface.Up(cfg.Interface.ListenPort); err != nil {
+		tunDevice.Close()
+		logger.Error("failed to bring the interface up", "name", *iface, "error", err)
+		os.Exit(1)
+	}
+	defer vpnInterface.Close()
+	if cfg.Interface.FwMark != 0 {
+		Must(0, vpnInterface.SetFwMark(cfg.Interface.FwMark))
+	}
+
+	logger.Info("interface is up", "name", *iface, "public_key", device.Local.PublicKey, "listen_port", vpnInterface.ListenPort())
+
+	if *client {
+		for _, tunnel := range device.Peers() {
+			vpnInterface.SendInitiation(tunnel)
 		}
 	}
+
+	control := &uapi.Server{Device: device, Bind: vpnInterface}
+	if listener, err := uapi.Listen(uapi.SocketPath(*iface)); err != nil {
+		logger.Warn("control socket is disabled", "error", err)
+	} else {
+		defer listener.Close()
+		go control.Serve(listener)
+		logger.Info("control socket is listening", "path", listener.Addr().String())
+	}
+
+	if *metricsAddr != "" {
+		listener := Must(net.Listen("tcp", *metricsAddr))
+		defer listener.Close()
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", &metrics.Handler{Device: device})
+		go http.Serve(listener, mux)
+		logger.Info("metrics endpoint is listening", "address", listener.Addr().String())
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+}
+
+// createTUN creates the TUN device of the interface. The userspace network stack holds the addresses
+// of the configuration itself, while the addresses of a kernel device are left to be configured with ip.
+func createTUN(name string, mtu int, iface config.Interface, userspace bool) (tun.Device, error) {
+	if !userspace {
+		return tun.CreateTUN(name, mtu)
+	}
+
+	addresses := make([]netip.Addr, 0, len(iface.Address))
+	for _, prefix := range iface.Address {
+		addresses = append(addresses, prefix.Addr())
+	}
+	device, _, err := netstack.CreateNetTUN(addresses, iface.DNS, mtu)
+	return device, err
 }
@@ -0,0 +1,109 @@
+// Package metrics exposes the counters of a device over HTTP
+// in the Prometheus text exposition format.
+//
+// See https://prometheus.io/docs/instrumenting/exposition_formats/
+package metrics
+
+import (
+	"bufio"
+	"com.github.grambbledook/simple_vpn/protocol"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const namespace = "simplevpn"
+
+// Handler serves the metrics of a device, peers are labelled with their base64 public key.
+type Handler struct {
+	Device *protocol.Device
+}
+
+// peerSnapshot is the state of a peer read under its lock, so that the counters are consistent.
+type peerSnapshot struct {
+	publicKey     string
+	stats         protocol.TunnelStats
+	lastHandshake time.Time
+}
+
+func (h *Handler) snapshot() []peerSnapshot {
+	var peers []peerSnapshot
+	for _, t := range h.Device.Peers() {
+		t.Lock()
+		peer := peerSnapshot{publicKey: t.Remote.PublicKey.ToBase64(), stats: t.TunnelStats}
+		t.Unlock()
+
+		peer.lastHandshake = t.Timers.LastHandshake()
+		peers = append(peers, peer)
+	}
+
+	slices.SortFunc(peers, func(a, b peerSnapshot) int {
+		return strings.Compare(a.publicKey, b.publicKey)
+	})
+	return peers
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	h.write(out)
+	out.Flush()
+}
+
+func (h *Handler) write(w *bufio.Writer) {
+	peers := h.snapshot()
+
+	perPeer := func(name, kind, help string, value func(peer peerSnapshot) float64) {
+		header(w, name, kind, help)
+		for _, peer := range peers {
+			fmt.Fprintf(w, "%s_%s{public_key=%q} %s\n", namespace, name, peer.publicKey, strconv.FormatFloat(value(peer), 'f', -1, 64))
+		}
+	}
+
+	perPeer("peer_receive_bytes_total", "counter", "Bytes of the authenticated transport messages received from the peer.",
+		func(peer peerSnapshot) float64 { return float64(peer.stats.RxBytes) })
+	perPeer("peer_transmit_bytes_total", "counter", "Bytes of the transport messages sent to the peer.",
+		func(peer peerSnapshot) float64 { return float64(peer.stats.TxBytes) })
+	perPeer("peer_receive_packets_total", "counter", "Authenticated transport messages received from the peer.",
+		func(peer peerSnapshot) float64 { return float64(peer.stats.RxPackets) })
+	perPeer("peer_transmit_packets_total", "counter", "Transport messages sent to the peer.",
+		func(peer peerSnapshot) float64 { return float64(peer.stats.TxPackets) })
+	perPeer("peer_handshake_attempts_total", "counter", "Handshake initiations created for the peer, retransmissions included.",
+		func(peer peerSnapshot) float64 { return float64(peer.stats.HandshakeAttempts) })
+	perPeer("peer_handshake_successes_total", "counter", "Sessions derived with the peer.",
+		func(peer peerSnapshot) float64 { return float64(peer.stats.HandshakeSuccesses) })
+	perPeer("peer_last_handshake_seconds", "gauge", "Unix time of the last completed handshake with the peer, 0 if there was none.",
+		func(peer peerSnapshot) float64 {
+			if peer.lastHandshake.IsZero() {
+				return 0
+			}
+			return float64(peer.lastHandshake.UnixNano()) / float64(time.Second)
+		})
+	perPeer("peer_replay_drops_total", "counter", "Transport messages from the peer dropped as replayed or outdated.",
+		func(peer peerSnapshot) float64 { return float64(peer.stats.ReplayDrops) })
+	perPeer("peer_keypair_rotations_total", "counter", "Keypairs which became current for the peer.",
+		func(peer peerSnapshot) float64 { return float64(peer.stats.KeypairRotations) })
+
+	stats := &h.Device.Stats
+	header(w, "handshake_failures_total", "counter", "Handshake messages rejected, by reason.")
+	for reason := protocol.HandshakeFailure(0); reason < protocol.HandshakeFailureReasons; reason++ {
+		fmt.Fprintf(w, "%s_handshake_failures_total{reason=%q} %d\n", namespace, reason, stats.HandshakeFailures[reason].Load())
+	}
+
+	header(w, "cookie_replies_sent_total", "counter", "Cookie replies sent while under load.")
+	fmt.Fprintf(w, "%s_cookie_replies_sent_total %d\n", namespace, stats.CookieRepliesSent.Load())
+}
+
+func header(w *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s_%s %s\n", namespace, name, help)
+	fmt.Fprintf(w, "# TYPE %s_%s %s\n", namespace, name, kind)
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"com.github.grambbledook/simple_vpn/protocol"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_Handler(t *testing.T) {
+	server := protocol.NewIdentity(protocol.NewPrivateKey())
+	client := protocol.NewIdentity(protocol.NewPrivateKey())
+
+	device := protocol.NewDevice(server.PrivateKey)
+	tunnel := device.AddPeer(protocol.Peer{PublicKey: client.PublicKey})
+	defer device.RemovePeer(client.PublicKey)
+
+	tunnel.Lock()
+	tunnel.RxBytes = 1234567
+	tunnel.ReplayDrops = 2
+	tunnel.Unlock()
+	device.Stats.HandshakeFailures[protocol.HandshakeFailureStaleTimestamp].Add(3)
+	device.Stats.CookieRepliesSent.Add(4)
+
+	handler := &Handler{Device: device}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+
+	body := recorder.Body.String()
+	label := `{public_key="` + client.PublicKey.ToBase64() + `"}`
+	for _, line := range []string{
+		"# TYPE simplevpn_peer_receive_bytes_total counter",
+		"simplevpn_peer_receive_bytes_total" + label + " 1234567",
+		"simplevpn_peer_transmit_packets_total" + label + " 0",
+		"simplevpn_peer_replay_drops_total" + label + " 2",
+		"simplevpn_peer_last_handshake_seconds" + label + " 0",
+		`simplevpn_handshake_failures_total{reason="stale_timestamp"} 3`,
+		`simplevpn_handshake_failures_total{reason="bad_mac1"} 0`,
+		"simplevpn_cookie_replies_sent_total 4",
+	} {
+		assert.Contains(t, strings.Split(body, "\n"), line)
+	}
+	assert.NotContains(t, body, server.PrivateKey.ToBase64())
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+}
@@ -0,0 +1,198 @@
+package protocol
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// AllowedIPs is the cryptokey routing table from section 2 of the whitepaper.
+// It maps destination addresses to peers with the longest prefix match,
+// and tells which peer is allowed to send packets from a given source address.
+type AllowedIPs struct {
+	mu   sync.RWMutex
+	ipv4 *trieNode
+	ipv6 *trieNode
+}
+
+// trieNode is a node of a binary trie, one level per bit of the address.
+type trieNode struct {
+	children [2]*trieNode
+	peer     *Tunnel
+}
+
+func addressBit(addr []byte, i int) int {
+	return int(addr[i/8]>>(7-i%8)) & 1
+}
+
+func (table *AllowedIPs) root(addr netip.Addr) **trieNode {
+	if addr.Is4() {
+		return &table.ipv4
+	}
+	return &table.ipv6
+}
+
+// unmapPrefix turns an IPv4-mapped IPv6 prefix into the IPv4 one,
+// as the addresses looked up are unmapped as well.
+func unmapPrefix(prefix netip.Prefix) netip.Prefix {
+	const mappedBits = 96
+	if prefix.Addr().Is4In6() && prefix.Bits() >= mappedBits {
+		return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-mappedBits)
+	}
+	return prefix
+}
+
+// Insert routes the prefix to the peer, replacing any previous owner of the same prefix.
+func (table *AllowedIPs) Insert(prefix netip.Prefix, peer *Tunnel) {
+	if !prefix.IsValid() {
+		return
+	}
+
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	prefix = unmapPrefix(prefix).Masked()
+	addr := prefix.Addr().AsSlice()
+
+	node := table.root(prefix.Addr())
+	for i := 0; i < prefix.Bits(); i++ {
+		if *node == nil {
+			*node = &trieNode{}
+		}
+		node = &(*node).children[addressBit(addr, i)]
+	}
+	if *node == nil {
+		*node = &trieNode{}
+	}
+	(*node).peer = peer
+}
+
+// Lookup returns the peer owning the most specific prefix containing the address.
+func (table *AllowedIPs) Lookup(addr netip.Addr) *Tunnel {
+	if !addr.IsValid() {
+		return nil
+	}
+
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+
+	addr = addr.Unmap()
+	bytes := addr.AsSlice()
+
+	var found *Tunnel
+	node := *table.root(addr)
+	for i := 0; node != nil; i++ {
+		if node.peer != nil {
+			found = node.peer
+		}
+		if i == addr.BitLen() {
+			break
+		}
+		node = node.children[addressBit(bytes, i)]
+	}
+	return found
+}
+
+// Remove deletes the prefix from the table if it is owned by the peer.
+func (table *AllowedIPs) Remove(prefix netip.Prefix, peer *Tunnel) {
+	if !prefix.IsValid() {
+		return
+	}
+
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	prefix = unmapPrefix(prefix).Masked()
+	addr := prefix.Addr().AsSlice()
+
+	// The slots on the path to the prefix, so that only this path is pruned
+	path := []**trieNode{table.root(prefix.Addr())}
+	for i := 0; i < prefix.Bits() && *path[i] != nil; i++ {
+		path = append(path, &(*path[i]).children[addressBit(addr, i)])
+	}
+
+	node := *path[len(path)-1]
+	if len(path) != prefix.Bits()+1 || node == nil || node.peer != peer {
+		return
+	}
+	node.peer = nil
+
+	for i := len(path) - 1; i >= 0; i-- {
+		node := *path[i]
+		if node.peer != nil || node.children[0] != nil || node.children[1] != nil {
+			break
+		}
+		*path[i] = nil
+	}
+}
+
+// RemoveByPeer deletes all the prefixes owned by the peer.
+func (table *AllowedIPs) RemoveByPeer(peer *Tunnel) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	for _, root := range []**trieNode{&table.ipv4, &table.ipv6} {
+		walk(*root, func(node *trieNode) {
+			if node.peer == peer {
+				node.peer = nil
+			}
+		})
+		prune(root)
+	}
+}
+
+// EntriesForPeer lists the prefixes owned by the peer.
+func (table *AllowedIPs) EntriesForPeer(peer *Tunnel) []netip.Prefix {
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+
+	var prefixes []netip.Prefix
+	collect(table.ipv4, make([]byte, 4), 0, peer, &prefixes)
+	collect(table.ipv6, make([]byte, 16), 0, peer, &prefixes)
+	return prefixes
+}
+
+func collect(node *trieNode, addr []byte, depth int, peer *Tunnel, prefixes *[]netip.Prefix) {
+	if node == nil {
+		return
+	}
+
+	if node.peer == peer {
+		ip, _ := netip.AddrFromSlice(addr)
+		*prefixes = append(*prefixes, netip.PrefixFrom(ip, depth))
+	}
+
+	if depth == len(addr)*8 {
+		return
+	}
+
+	for bit, child := range node.children {
+		next := make([]byte, len(addr))
+		copy(next, addr)
+		next[depth/8] |= byte(bit) << (7 - depth%8)
+		collect(child, next, depth+1, peer, prefixes)
+	}
+}
+
+func walk(node *trieNode, f func(*trieNode)) {
+	if node == nil {
+		return
+	}
+	f(node)
+	walk(node.children[0], f)
+	walk(node.children[1], f)
+}
+
+// prune removes the branches without any peers.
+func prune(node **trieNode) bool {
+	if *node == nil {
+		return true
+	}
+
+	empty0 := prune(&(*node).children[0])
+	empty1 := prune(&(*node).children[1])
+	if empty0 && empty1 && (*node).peer == nil {
+		*node = nil
+		return true
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package protocol
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/netip"
+	"testing"
+)
+
+func Test_AllowedIPs_LongestPrefixMatch(t *testing.T) {
+	var table AllowedIPs
+	a, b, c, d := &Tunnel{}, &Tunnel{}, &Tunnel{}, &Tunnel{}
+
+	table.Insert(netip.MustParsePrefix("0.0.0.0/0"), a)
+	table.Insert(netip.MustParsePrefix("10.0.0.0/8"), b)
+	table.Insert(netip.MustParsePrefix("10.1.0.0/16"), c)
+	table.Insert(netip.MustParsePrefix("10.1.2.3/32"), d)
+
+	tests := map[string]*Tunnel{
+		"8.8.8.8":         a,
+		"10.200.0.1":      b,
+		"10.1.200.1":      c,
+		"10.1.2.3":        d,
+		"10.1.2.4":        c,
+		"::ffff:10.1.2.3": d,
+		"fd00::1":         nil,
+	}
+	for addr, expected := range tests {
+		assert.Equal(t, expected, table.Lookup(netip.MustParseAddr(addr)), addr)
+	}
+}
+
+func Test_AllowedIPs_IPv6(t *testing.T) {
+	var table AllowedIPs
+	a, b := &Tunnel{}, &Tunnel{}
+
+	table.Insert(netip.MustParsePrefix("::/0"), a)
+	table.Insert(netip.MustParsePrefix("2001:db8::/32"), b)
+	table.Insert(netip.MustParsePrefix("2001:db8:1::1/128"), a)
+
+	assert.Equal(t, a, table.Lookup(netip.MustParseAddr("2001:4860::8888")))
+	assert.Equal(t, b, table.Lookup(netip.MustParseAddr("2001:db8:1::2")))
+	assert.Equal(t, a, table.Lookup(netip.MustParseAddr("2001:db8:1::1")))
+	assert.Nil(t, table.Lookup(netip.MustParseAddr("10.0.0.1")), "IPv4 is routed separately")
+}
+
+func Test_AllowedIPs_InsertReplacesOwner(t *testing.T) {
+	var table AllowedIPs
+	a, b := &Tunnel{}, &Tunnel{}
+
+	table.Insert(netip.MustParsePrefix("192.168.0.0/24"), a)
+	table.Insert(netip.MustParsePrefix("192.168.0.77/24"), b)
+
+	assert.Equal(t, b, table.Lookup(netip.MustParseAddr("192.168.0.1")))
+	assert.Empty(t, table.EntriesForPeer(a))
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("192.168.0.0/24")}, table.EntriesForPeer(b))
+}
+
+func Test_AllowedIPs_Remove(t *testing.T) {
+	var table AllowedIPs
+	a, b := &Tunnel{}, &Tunnel{}
+
+	table.Insert(netip.MustParsePrefix("10.0.0.0/8"), a)
+	table.Insert(netip.MustParsePrefix("10.1.0.0/16"), b)
+	table.Insert(netip.MustParsePrefix("fd00::/8"), b)
+
+	table.Remove(netip.MustParsePrefix("10.0.0.0/8"), b)
+	assert.Equal(t, a, table.Lookup(netip.MustParseAddr("10.2.0.1")), "prefix owned by another peer is kept")
+
+	table.Remove(netip.MustParsePrefix("10.1.0.0/16"), b)
+	assert.Equal(t, a, table.Lookup(netip.MustParseAddr("10.1.0.1")))
+
+	table.Insert(netip.MustParsePrefix("10.1.0.0/16"), b)
+	table.RemoveByPeer(b)
+	assert.Equal(t, a, table.Lookup(netip.MustParseAddr("10.1.0.1")))
+	assert.Nil(t, table.Lookup(netip.MustParseAddr("fd00::1")))
+	assert.Nil(t, table.ipv6, "empty branches are pruned")
+
+	table.RemoveByPeer(a)
+	assert.Nil(t, table.ipv4)
+}
+
+func Test_AllowedIPs_RemovePrunesPath(t *testing.T) {
+	var table AllowedIPs
+	a := &Tunnel{}
+
+	table.Insert(netip.MustParsePrefix("10.0.0.0/8"), a)
+	table.Insert(netip.MustParsePrefix("10.1.2.0/24"), a)
+	table.Insert(netip.MustParsePrefix("fd00::/8"), a)
+
+	table.Remove(netip.MustParsePrefix("10.1.0.0/16"), a)
+	assert.Equal(t, a, table.Lookup(netip.MustParseAddr("10.1.2.3")), "a missing prefix changes nothing")
+
+	table.Remove(netip.MustParsePrefix("10.1.2.0/24"), a)
+	node := table.ipv4
+	for i := 0; i < 8; i++ {
+		node = node.children[addressBit([]byte{10}, i)]
+	}
+	assert.Equal(t, a, node.peer)
+	assert.Equal(t, [2]*trieNode{}, node.children, "the branch of the removed prefix is pruned")
+
+	table.Remove(netip.MustParsePrefix("fd00::/8"), a)
+	assert.Nil(t, table.ipv6)
+}
+
+func Test_AllowedIPs_MappedPrefix(t *testing.T) {
+	var table AllowedIPs
+	a := &Tunnel{}
+
+	table.Insert(netip.MustParsePrefix("::ffff:10.0.0.0/104"), a)
+	assert.Equal(t, a, table.Lookup(netip.MustParseAddr("10.0.0.1")))
+	assert.Equal(t, a, table.Lookup(netip.MustParseAddr("::ffff:10.0.0.1")))
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, table.EntriesForPeer(a))
+
+	table.Remove(netip.MustParsePrefix("::ffff:10.0.0.0/104"), a)
+	assert.Nil(t, table.Lookup(netip.MustParseAddr("10.0.0.1")))
+	assert.Nil(t, table.ipv4)
+}
+
+func Test_AllowedIPs_EntriesForPeer(t *testing.T) {
+	var table AllowedIPs
+	a, b := &Tunnel{}, &Tunnel{}
+
+	prefixes := []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("10.0.0.2/32"),
+		netip.MustParsePrefix("172.16.0.0/12"),
+		netip.MustParsePrefix("fd00:1234::/32"),
+	}
+	for _, prefix := range prefixes {
+		table.Insert(prefix, a)
+	}
+	table.Insert(netip.MustParsePrefix("10.0.0.3/32"), b)
+
+	assert.ElementsMatch(t, prefixes, table.EntriesForPeer(a))
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.3/32")}, table.EntriesForPeer(b))
+}
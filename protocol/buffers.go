@@ -0,0 +1,37 @@
+package protocol
+
+import (
+	"sync"
+)
+
+const (
+	// MaxMessageSize is the largest datagram, which also fits segments coalesced by UDP GRO.
+	MaxMessageSize = (1 << 16) - 1
+
+	// MessageTransportOffsetContent is the headroom in front of an inner packet,
+	// so the transport header is written without moving the packet.
+	MessageTransportOffsetContent = MessageTransportHeaderSize
+
+	// MaxContentSize is the largest inner packet which fits a MessageBuffer once padded and sealed.
+	MaxContentSize = (MaxMessageSize - MessageTransportMinSize) &^ (PaddingMultiple - 1)
+)
+
+// MessageBuffer holds a whole datagram. An inner packet is placed at MessageTransportOffsetContent
+// and is encrypted in place, followed by its padding and authentication tag.
+type MessageBuffer [MaxMessageSize]byte
+
+// BufferPool recycles message buffers. The zero value is ready to use.
+type BufferPool struct {
+	pool sync.Pool
+}
+
+func (p *BufferPool) Get() *MessageBuffer {
+	if buffer, ok := p.pool.Get().(*MessageBuffer); ok {
+		return buffer
+	}
+	return new(MessageBuffer)
+}
+
+func (p *BufferPool) Put(buffer *MessageBuffer) {
+	p.pool.Put(buffer)
+}
@@ -3,3 +3,21 @@ package protocol
 import "time"
 
 const CookieRefreshTime = 120 * time.Second
+
+const (
+	RekeyAfterMessages  = 1 << 60
+	RejectAfterMessages = (1 << 64) - (1 << 13) - 1
+	PaddingMultiple     = 16
+)
+
+// Timer constants from section 6.1 of the whitepaper
+const (
+	RekeyAfterTime         = 120 * time.Second
+	RejectAfterTime        = 180 * time.Second
+	RekeyAttemptTime       = 90 * time.Second
+	RekeyTimeout           = 5 * time.Second
+	RekeyTimeoutJitterMax  = 334 * time.Millisecond
+	KeepaliveTimeout       = 10 * time.Second
+	MaxHandshakeAttempts   = int(RekeyAttemptTime / RekeyTimeout)
+	ZeroKeyMaterialTimeout = 3 * RejectAfterTime
+)
@@ -2,55 +2,154 @@ package protocol
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
+	"errors"
 	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"net/netip"
+	"sync"
 	"time"
 )
 
+// Checker verifies MACs of incoming handshake messages and produces cookie replies.
+// Mac2Key is the key used to encrypt cookies sent to the initiators.
 type Checker struct {
 	Mac1Key        [32]byte
 	Mac2Key        [32]byte
 	LastCookieTime time.Time
+	Clock          Clock
+
+	mu     sync.Mutex
+	secret [blake2s.Size]byte
 }
 
 func (ch *Checker) Init(pk PublicKey) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
 	HASH(&ch.Mac1Key, LabelMac1[:], pk[:])
 	HASH(&ch.Mac2Key, LabelCookie[:], pk[:])
 }
 
+// keys returns a snapshot of the keys, which are replaced when the local identity changes.
+func (ch *Checker) keys() (mac1Key, mac2Key [32]byte) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return ch.Mac1Key, ch.Mac2Key
+}
+
+func (ch *Checker) now() time.Time {
+	if ch.Clock == nil {
+		return time.Now()
+	}
+	return ch.Clock.Now()
+}
+
+// cookie computes the cookie for the source address of a message.
+//
+// 5.4.7 of the whitepaper:
+// τ := Mac(Rm, Am'), where Rm is a random secret changing every 2 minutes
+// and Am' is the concatenation of the source IP address and UDP port.
+func (ch *Checker) cookie(cookie *[blake2s.Size128]byte, src netip.AddrPort) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if now := ch.now(); now.Sub(ch.LastCookieTime) > CookieRefreshTime {
+		if _, err := rand.Read(ch.secret[:]); err != nil {
+			return err
+		}
+		ch.LastCookieTime = now
+	}
+
+	address, err := src.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	mac, _ := blake2s.New128(ch.secret[:])
+	mac.Write(address)
+	mac.Sum(cookie[:0])
+	return nil
+}
+
 func (ch *Checker) CheckMAC1(msg []byte) bool {
 	size := len(msg)
 	offsetMac2 := size - CookieSize
 	offsetMac1 := offsetMac2 - CookieSize
 
 	var mac1 [blake2s.Size128]byte
+	mac1Key, _ := ch.keys()
 
-	mac, _ := blake2s.New128(ch.Mac1Key[:])
+	mac, _ := blake2s.New128(mac1Key[:])
 	mac.Write(msg[:offsetMac1])
 	mac.Sum(mac1[:0])
 
 	return hmac.Equal(mac1[:], msg[offsetMac1:offsetMac2])
 }
 
-// CheckMAC2 This implementation is incorrect,
-// should be fixed according to 5.4.7 of the whitepaper
-func (ch *Checker) CheckMAC2(msg []byte) bool {
+// CheckMAC2 verifies that the message was stamped with the cookie
+// previously given to its source address.
+//
+// 5.4.4 of the whitepaper:
+// msg.mac2 := Mac(τ, msgβ)
+func (ch *Checker) CheckMAC2(msg []byte, src netip.AddrPort) bool {
 	size := len(msg)
 	offsetMac2 := size - CookieSize
 
+	var cookie [blake2s.Size128]byte
+	if err := ch.cookie(&cookie, src); err != nil {
+		return false
+	}
+
 	var mac2 [blake2s.Size128]byte
 
-	mac, _ := blake2s.New128(ch.Mac2Key[:])
+	mac, _ := blake2s.New128(cookie[:])
 	mac.Write(msg[:offsetMac2])
 	mac.Sum(mac2[:0])
 
 	return hmac.Equal(mac2[:], msg[offsetMac2:])
 }
 
+// CreateReply encrypts a cookie for the source of the message,
+// using mac1 of the message as associated data.
+//
+// 5.4.7 of the whitepaper:
+// msg.cookie := XAEAD(HASH(LABEL-COOKIE || Spubm), msg.nonce, τ, M)
+func (ch *Checker) CreateReply(msg []byte, receiver uint32, src netip.AddrPort) (MessageHandshakeCookie, error) {
+	size := len(msg)
+	offsetMac2 := size - CookieSize
+	offsetMac1 := offsetMac2 - CookieSize
+
+	var cookie [blake2s.Size128]byte
+	if err := ch.cookie(&cookie, src); err != nil {
+		return MessageHandshakeCookie{}, err
+	}
+
+	reply := MessageHandshakeCookie{
+		Type:     HandshakeCookieType,
+		Receiver: receiver,
+	}
+	if _, err := rand.Read(reply.Nonce[:]); err != nil {
+		return MessageHandshakeCookie{}, err
+	}
+
+	_, mac2Key := ch.keys()
+	aead, _ := chacha20poly1305.NewX(mac2Key[:])
+	aead.Seal(reply.Cookie[:0], reply.Nonce[:], cookie[:], msg[offsetMac1:offsetMac2])
+
+	return reply, nil
+}
+
+// Stamper adds MACs to outgoing handshake messages. Mac2Key is the key
+// used to decrypt cookies received from the responder.
 type Stamper struct {
 	Mac1Key        [blake2s.Size]byte
 	Mac2Key        [blake2s.Size]byte
 	Cookie         [blake2s.Size128]byte
 	LastCookieTime time.Time
+	LastMAC1       [blake2s.Size128]byte
+	Clock          Clock
 }
 
 func (st *Stamper) Init(pk PublicKey) {
@@ -58,6 +157,13 @@ func (st *Stamper) Init(pk PublicKey) {
 	HASH(&st.Mac2Key, LabelCookie[:], pk[:])
 }
 
+func (st *Stamper) now() time.Time {
+	if st.Clock == nil {
+		return time.Now()
+	}
+	return st.Clock.Now()
+}
+
 func (st *Stamper) Stamp(msg []byte) {
 	size := len(msg)
 	offsetMac2 := size - CookieSize
@@ -72,7 +178,10 @@ func (st *Stamper) Stamp(msg []byte) {
 		hash.Sum(mac1[:0])
 	}
 
-	if time.Since(st.LastCookieTime) > CookieRefreshTime {
+	// A cookie reply is bound to the mac1 of the message it answers
+	copy(st.LastMAC1[:], mac1)
+
+	if st.now().Sub(st.LastCookieTime) > CookieRefreshTime {
 		return
 	}
 
@@ -87,3 +196,22 @@ func (st *Stamper) Stamp(msg []byte) {
 		hash.Sum(mac2[:0])
 	}
 }
+
+// ConsumeReply decrypts the cookie from a cookie reply,
+// so the following handshake messages are stamped with mac2.
+//
+// 5.4.7 of the whitepaper:
+// τ := XAEAD-Decrypt(HASH(LABEL-COOKIE || Spubm), msg.nonce, msg.cookie, M)
+// where M is the mac1 of the last message sent to the responder.
+func (st *Stamper) ConsumeReply(reply MessageHandshakeCookie) error {
+	var cookie [blake2s.Size128]byte
+
+	aead, _ := chacha20poly1305.NewX(st.Mac2Key[:])
+	if _, err := aead.Open(cookie[:0], reply.Nonce[:], reply.Cookie[:], st.LastMAC1[:]); err != nil {
+		return errors.New("failed to decrypt the cookie")
+	}
+
+	st.Cookie = cookie
+	st.LastCookieTime = st.now()
+	return nil
+}
@@ -2,8 +2,13 @@ package protocol
 
 import (
 	"encoding/base64"
+	"encoding/hex"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"net/netip"
 	"testing"
+	"time"
 )
 
 func Test_StamperMac1(t *testing.T) {
@@ -41,3 +46,257 @@ func Test_StamperMac1(t *testing.T) {
 
 	assert.True(t, checker.CheckMAC1(data), "Mac1 verification failed")
 }
+
+func openCookieReply(t *testing.T, pk PublicKey, reply MessageHandshakeCookie, msg []byte) [blake2s.Size128]byte {
+	var key [blake2s.Size]byte
+	HASH(&key, LabelCookie, pk[:])
+
+	mac2 := len(msg) - CookieSize
+	mac1 := mac2 - CookieSize
+
+	var cookie [blake2s.Size128]byte
+	aead, _ := chacha20poly1305.NewX(key[:])
+	_, err := aead.Open(cookie[:0], reply.Nonce[:], reply.Cookie[:], msg[mac1:mac2])
+	assert.Nil(t, err)
+	return cookie
+}
+
+func Test_Checker_CookieReply(t *testing.T) {
+	responder := newIdentity()
+	clock := newManualClock()
+
+	checker := Checker{Clock: clock}
+	checker.Init(responder.PublicKey)
+
+	var stamper Stamper
+	stamper.Init(responder.PublicKey)
+
+	msg := make([]byte, MessageHandshakeInitSize)
+	msg[0] = HandshakeInitType
+	stamper.Stamp(msg)
+
+	src := netip.MustParseAddrPort("192.0.2.1:51820")
+	assert.False(t, checker.CheckMAC2(msg, src), "mac2 is empty without a cookie")
+
+	reply, err := checker.CreateReply(msg, 42, src)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(HandshakeCookieType), reply.Type)
+	assert.Equal(t, uint32(42), reply.Receiver)
+
+	stamper.Cookie = openCookieReply(t, responder.PublicKey, reply, msg)
+	stamper.LastCookieTime = time.Now()
+	stamper.Stamp(msg)
+
+	assert.True(t, checker.CheckMAC1(msg))
+	assert.True(t, checker.CheckMAC2(msg, src))
+	assert.False(t, checker.CheckMAC2(msg, netip.MustParseAddrPort("192.0.2.1:51821")), "cookie is bound to the port")
+	assert.False(t, checker.CheckMAC2(msg, netip.MustParseAddrPort("192.0.2.2:51820")), "cookie is bound to the address")
+
+	clock.Advance(CookieRefreshTime + time.Second)
+	assert.False(t, checker.CheckMAC2(msg, src), "cookie expires with the secret")
+}
+
+func Test_Device_CookieReplyUnderLoad(t *testing.T) {
+	server := newIdentity()
+	device := NewDevice(server.PrivateKey)
+	device.Load.Threshold = 1
+
+	client := newIdentity()
+	device.AddPeer(Peer{PublicKey: client.PublicKey})
+	initiator := NewDevice(client.PrivateKey).AddPeer(Peer{PublicKey: server.PublicKey})
+
+	src := netip.MustParseAddrPort("198.51.100.7:40000")
+	initiation := func() []byte {
+		ih, err := initiator.InitiateHandshake()
+		assert.Nil(t, err)
+		msg := ih.ToBytes()
+		initiator.Stamper.Stamp(msg)
+		return msg
+	}
+
+	reply, err := device.CheckHandshakeMACs(initiation(), 1, src)
+	assert.Nil(t, err)
+	assert.Nil(t, reply, "no cookie reply below the threshold")
+
+	msg := initiation()
+	reply, err = device.CheckHandshakeMACs(msg, 2, src)
+	assert.NotNil(t, err)
+	assert.NotNil(t, reply, "cookie reply under load")
+	assert.Equal(t, uint32(2), reply.Receiver)
+
+	assert.Nil(t, initiator.Stamper.ConsumeReply(*reply))
+
+	reply, err = device.CheckHandshakeMACs(initiation(), 3, src)
+	assert.Nil(t, err, "messages with a valid cookie are processed under load")
+	assert.Nil(t, reply)
+
+	msg = initiation()
+	msg[len(msg)-2*CookieSize] ^= 0xff
+	_, err = device.CheckHandshakeMACs(msg, 4, src)
+	assert.NotNil(t, err, "invalid mac1 is always rejected")
+}
+
+func Test_LoadMonitor(t *testing.T) {
+	monitor := LoadMonitor{Threshold: 3}
+	now := time.Unix(1_700_000_000, 0)
+
+	for i := 0; i < 3; i++ {
+		assert.False(t, monitor.Observe(now))
+	}
+	assert.True(t, monitor.Observe(now))
+
+	now = now.Add(UnderLoadAfterTime / 2)
+	assert.True(t, monitor.Observe(now), "stays under load for a while")
+
+	now = now.Add(UnderLoadAfterTime)
+	assert.False(t, monitor.Observe(now))
+}
+
+// Vectors below were cross-checked against an independent BLAKE2s implementation.
+// Address is encoded as the IP address followed by the little-endian port,
+// the message is filled with byte(i * 7).
+func cookieVectorMessage() []byte {
+	msg := make([]byte, MessageHandshakeInitSize)
+	for i := range msg {
+		msg[i] = byte(i * 7)
+	}
+	return msg
+}
+
+func Test_Checker_MAC2Vector(t *testing.T) {
+	pk := PkFromString("pMo33VR8Lwi0nmi3sAFTFttomPI71LSMkEjFXws94wU=")
+	src := netip.MustParseAddrPort("192.0.2.1:51820")
+
+	checker := Checker{}
+	checker.Init(pk)
+	for i := range checker.secret {
+		checker.secret[i] = byte(i)
+	}
+	checker.LastCookieTime = time.Now()
+
+	var cookie [blake2s.Size128]byte
+	assert.Nil(t, checker.cookie(&cookie, src))
+	assert.Equal(t, "06fc4064540b2f5953eabe5127727206", hex.EncodeToString(cookie[:]))
+
+	msg := cookieVectorMessage()
+	mac2 := len(msg) - CookieSize
+	mac1 := mac2 - CookieSize
+	copy(msg[mac1:], Must(hex.DecodeString("a5f1acc1081136aa3263825b8e25a4ac")))
+	copy(msg[mac2:], Must(hex.DecodeString("0c2ea30b460258867819d2717fa27968")))
+
+	assert.True(t, checker.CheckMAC1(msg))
+	assert.True(t, checker.CheckMAC2(msg, src))
+
+	msg[0] ^= 1
+	assert.False(t, checker.CheckMAC2(msg, src), "mac2 covers the message and mac1")
+}
+
+func Test_Stamper_MAC2Vector(t *testing.T) {
+	pk := PkFromString("pMo33VR8Lwi0nmi3sAFTFttomPI71LSMkEjFXws94wU=")
+
+	var stamper Stamper
+	stamper.Init(pk)
+	copy(stamper.Cookie[:], Must(hex.DecodeString("06fc4064540b2f5953eabe5127727206")))
+	stamper.LastCookieTime = time.Now()
+
+	msg := cookieVectorMessage()
+	stamper.Stamp(msg)
+
+	mac2 := len(msg) - CookieSize
+	mac1 := mac2 - CookieSize
+	assert.Equal(t, "a5f1acc1081136aa3263825b8e25a4ac", hex.EncodeToString(msg[mac1:mac2]))
+	assert.Equal(t, "0c2ea30b460258867819d2717fa27968", hex.EncodeToString(msg[mac2:]))
+	assert.Equal(t, msg[mac1:mac2], stamper.LastMAC1[:])
+}
+
+func Test_Stamper_ConsumeReplyVector(t *testing.T) {
+	pk := PkFromString("pMo33VR8Lwi0nmi3sAFTFttomPI71LSMkEjFXws94wU=")
+
+	var stamper Stamper
+	stamper.Init(pk)
+	stamper.Stamp(cookieVectorMessage())
+
+	reply := MessageHandshakeCookie{Type: HandshakeCookieType}
+	for i := range reply.Nonce {
+		reply.Nonce[i] = byte(0xa0 + i)
+	}
+	copy(reply.Cookie[:], Must(hex.DecodeString("33733c71276b7c238e289b9aad720718821db461110766d1a33d26eabce613d4")))
+
+	assert.Nil(t, stamper.ConsumeReply(reply))
+	assert.Equal(t, "06fc4064540b2f5953eabe5127727206", hex.EncodeToString(stamper.Cookie[:]))
+	assert.WithinDuration(t, time.Now(), stamper.LastCookieTime, time.Second)
+}
+
+func Test_Stamper_ConsumeReplyBoundToLastMAC1(t *testing.T) {
+	responder := newIdentity()
+
+	checker := Checker{}
+	checker.Init(responder.PublicKey)
+
+	var stamper Stamper
+	stamper.Init(responder.PublicKey)
+
+	src := netip.MustParseAddrPort("203.0.113.9:1234")
+	first := make([]byte, MessageHandshakeInitSize)
+	first[0] = HandshakeInitType
+	stamper.Stamp(first)
+
+	reply, err := checker.CreateReply(first, 1, src)
+	assert.Nil(t, err)
+
+	// A reply to an older message is not accepted
+	second := make([]byte, MessageHandshakeInitSize)
+	second[0], second[1] = HandshakeInitType, 1
+	stamper.Stamp(second)
+	assert.NotNil(t, stamper.ConsumeReply(reply))
+	assert.True(t, stamper.LastCookieTime.IsZero())
+
+	reply, err = checker.CreateReply(second, 1, src)
+	assert.Nil(t, err)
+	assert.Nil(t, stamper.ConsumeReply(reply))
+
+	third := make([]byte, MessageHandshakeInitSize)
+	third[0] = HandshakeInitType
+	stamper.Stamp(third)
+	assert.True(t, checker.CheckMAC2(third, src))
+}
+
+func Test_Device_ConsumesCookieReply(t *testing.T) {
+	server := newIdentity()
+	device := NewDevice(server.PrivateKey)
+	device.Load.Threshold = 0
+
+	client := newIdentity()
+	device.AddPeer(Peer{PublicKey: client.PublicKey})
+	clientDevice := NewDevice(client.PrivateKey)
+	initiator := clientDevice.AddPeer(Peer{PublicKey: server.PublicKey})
+
+	src := netip.MustParseAddrPort("198.51.100.7:40000")
+
+	ih, err := initiator.InitiateHandshake()
+	assert.Nil(t, err)
+	msg := ih.ToBytes()
+	initiator.Stamper.Stamp(msg)
+
+	reply, err := device.CheckHandshakeMACs(msg, ih.Sender, src)
+	assert.NotNil(t, err)
+	assert.NotNil(t, reply)
+
+	tunnel, err := clientDevice.ProcessHandshakeCookieMessage(*reply)
+	assert.Nil(t, err)
+	assert.Equal(t, initiator, tunnel)
+
+	// Retransmission carries a valid mac2 and passes under load
+	ih, err = initiator.InitiateHandshake()
+	assert.Nil(t, err)
+	msg = ih.ToBytes()
+	initiator.Stamper.Stamp(msg)
+
+	reply, err = device.CheckHandshakeMACs(msg, ih.Sender, src)
+	assert.Nil(t, err)
+	assert.Nil(t, reply)
+
+	tunnel, err = device.ProcessInitiateHandshakeMessage(ih, netip.AddrPort{})
+	assert.Nil(t, err)
+	assert.Equal(t, client.PublicKey, tunnel.Remote.PublicKey)
+}
@@ -132,6 +132,12 @@ func NewPrivateKey() (sk PrivateKey) {
 	return sk
 }
 
+func NewPresharedKey() (psk PresharedKey) {
+	rand.Read(psk[:])
+
+	return psk
+}
+
 // Decent explanation of why
 // https://neilmadden.blog/2020/05/28/whats-the-curve25519-clamping-all-about
 func (sk *PrivateKey) clamp() {
@@ -0,0 +1,368 @@
+package protocol
+
+import (
+	"errors"
+	"log/slog"
+	"net/netip"
+	"sync"
+)
+
+// TimestampStore persists the timestamp of the last initiation accepted from each peer,
+// so that initiations captured before a restart can't be replayed after it.
+// Store is called with the tunnel lock held, so it must not wait for the disk.
+type TimestampStore interface {
+	Load(pk PublicKey) (Tai64n, bool)
+	Store(pk PublicKey, ts Tai64n) error
+}
+
+// Device owns the local identity and all the configured peers.
+// Incoming messages carrying a Receiver field are routed to the
+// peer by the index allocated during the handshake.
+// Timestamps is optional, without it the timestamps are only kept in memory.
+// Logger is passed on to the tunnels of the peers added after it is set, nothing is logged without it.
+// Stats counts the rejected handshake messages and the cookie replies, the rest is counted per tunnel.
+// OnPeerAdded configures the timers of every added tunnel before they start, so that
+// their callbacks and the keepalive interval may be set without racing with the timers.
+type Device struct {
+	Local      Identity
+	Indices    IndexTable
+	Clock      Clock
+	Checker    Checker
+	Load       LoadMonitor
+	AllowedIPs AllowedIPs
+	Timestamps TimestampStore
+	Logger     *slog.Logger
+	Stats      DeviceStats
+
+	OnPeerAdded func(*Tunnel)
+
+	mu    sync.RWMutex
+	peers map[PublicKey]*Tunnel
+}
+
+// NewDevice creates a device with the identity derived from the private key.
+func NewDevice(sk PrivateKey) *Device {
+	local := NewIdentity(sk)
+	d := &Device{
+		Local: local,
+		Clock: SystemClock{},
+		Load:  LoadMonitor{Threshold: DefaultHandshakeLoadThreshold},
+		peers: make(map[PublicKey]*Tunnel),
+	}
+	d.Checker.Init(local.PublicKey)
+	d.Checker.Clock = d.Clock
+	return d
+}
+
+// AddPeer registers a remote peer, returning the existing tunnel if the peer is already known.
+func (d *Device) AddPeer(remote Peer) *Tunnel {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if t, ok := d.peers[remote.PublicKey]; ok {
+		return t
+	}
+
+	t := &Tunnel{
+		Local:   d.Local,
+		Remote:  remote,
+		Indices: &d.Indices,
+		Logger:  loggerOrDiscard(d.Logger).With("peer", remote.PublicKey),
+	}
+	t.Initialise()
+
+	if d.Timestamps != nil {
+		if ts, ok := d.Timestamps.Load(remote.PublicKey); ok {
+			t.Handshake.LastTimestamp = ts
+		}
+	}
+
+	t.Timers.Clock = d.Clock
+	t.Timers.Logger = t.Logger
+	t.Stamper.Clock = d.Clock
+	t.Timers.OnZeroKeyMaterial = func() {
+		t.Lock()
+		defer t.Unlock()
+
+		t.ZeroKeyMaterial()
+	}
+	if d.OnPeerAdded != nil {
+		d.OnPeerAdded(t)
+	}
+	t.Timers.Start()
+
+	d.peers[remote.PublicKey] = t
+	t.Logger.Info("peer added")
+	return t
+}
+
+func (d *Device) RemovePeer(pk PublicKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.peers[pk]
+	if !ok {
+		return
+	}
+
+	t.Timers.Stop()
+	d.AllowedIPs.RemoveByPeer(t)
+
+	t.Lock()
+	t.ZeroKeyMaterial()
+	t.Unlock()
+
+	delete(d.peers, pk)
+	t.Logger.Info("peer removed")
+}
+
+// Identity returns the local identity, which may be replaced with SetPrivateKey.
+func (d *Device) Identity() Identity {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.Local
+}
+
+// SetPrivateKey replaces the local identity. Sessions established with the previous
+// identity are dropped, and a peer having the new public key is removed,
+// since a device can't have a tunnel to itself.
+func (d *Device) SetPrivateKey(sk PrivateKey) {
+	local := NewIdentity(sk)
+
+	d.RemovePeer(local.PublicKey)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Local = local
+	d.Checker.Init(local.PublicKey)
+	loggerOrDiscard(d.Logger).Info("private key changed", "public_key", local.PublicKey)
+
+	for _, t := range d.peers {
+		t.Lock()
+		t.ZeroKeyMaterial()
+		t.Local = local
+		t.Initialise()
+		t.Unlock()
+	}
+}
+
+func (d *Device) LookupPeer(pk PublicKey) *Tunnel {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.peers[pk]
+}
+
+func (d *Device) Peers() []*Tunnel {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	peers := make([]*Tunnel, 0, len(d.peers))
+	for _, t := range d.peers {
+		peers = append(peers, t)
+	}
+	return peers
+}
+
+// CheckHandshakeMACs validates MACs of a raw handshake message before any expensive processing.
+// When the device is under load, messages without a valid mac2 are answered with a cookie reply
+// which is returned along with an error, so the message itself is dropped.
+func (d *Device) CheckHandshakeMACs(msg []byte, sender uint32, src netip.AddrPort) (*MessageHandshakeCookie, error) {
+	if !d.Checker.CheckMAC1(msg) {
+		d.Stats.HandshakeFailures[HandshakeFailureMAC1].Add(1)
+		return nil, errors.New("invalid mac1")
+	}
+
+	if !d.Load.Observe(d.Clock.Now()) {
+		return nil, nil
+	}
+
+	if d.Checker.CheckMAC2(msg, src) {
+		return nil, nil
+	}
+
+	reply, err := d.Checker.CreateReply(msg, sender, src)
+	if err != nil {
+		return nil, err
+	}
+	loggerOrDiscard(d.Logger).Debug("under load, replying with a cookie", "endpoint", src)
+	return &reply, errors.New("under load, cookie reply sent")
+}
+
+// learnEndpoint records the address an authenticated message came from,
+// so that replies follow the peer when it roams between networks.
+// The caller must hold the tunnel lock.
+func learnEndpoint(t *Tunnel, src netip.AddrPort) {
+	if !src.IsValid() {
+		return
+	}
+
+	endpoint := netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+	if endpoint != t.Endpoint {
+		t.logger().Debug("endpoint changed", "endpoint", endpoint)
+		t.Endpoint = endpoint
+	}
+}
+
+func (d *Device) lookupReceiver(receiver uint32) (*Tunnel, error) {
+	t := d.Indices.Lookup(receiver)
+	if t == nil {
+		return nil, errors.New("unknown receiver index")
+	}
+	return t, nil
+}
+
+// ProcessInitiateHandshakeResponseMessage routes a handshake response to the tunnel that initiated the handshake.
+// The peer endpoint is updated to src once the response is authenticated.
+func (d *Device) ProcessInitiateHandshakeResponseMessage(message MessageHandshakeResponse, src netip.AddrPort) (*Tunnel, error) {
+	t, err := d.lookupReceiver(message.Receiver)
+	if err != nil {
+		d.Stats.handshakeFailed(err)
+		return nil, err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if t.Handshake.Status != InitiateHandshakeMessageSent {
+		err := errors.New("unexpected handshake response")
+		d.Stats.handshakeFailed(err)
+		return nil, err
+	}
+
+	if err := t.ProcessInitiateHandshakeResponseMessage(message); err != nil {
+		d.Stats.handshakeFailed(err)
+		return nil, err
+	}
+	learnEndpoint(t, src)
+	return t, nil
+}
+
+// ProcessHandshakeCookieMessage routes a cookie reply to the tunnel it was addressed to
+// and stores the cookie for the following handshake messages.
+func (d *Device) ProcessHandshakeCookieMessage(message MessageHandshakeCookie) (*Tunnel, error) {
+	t, err := d.lookupReceiver(message.Receiver)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if err := t.Stamper.ConsumeReply(message); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ProcessTransportMessage routes a transport message to its tunnel and decrypts it.
+// Inner packets are accepted only from source addresses allowed for the sending peer.
+// The peer endpoint is updated to src once the message is authenticated and not a replay.
+func (d *Device) ProcessTransportMessage(message MessageTransport, src netip.AddrPort) (*Tunnel, []byte, error) {
+	t, err := d.lookupReceiver(message.Receiver)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t.Lock()
+	packet, err := t.ProcessTransportMessage(message)
+	if err == nil {
+		learnEndpoint(t, src)
+	}
+	t.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := d.checkSource(t, packet); err != nil {
+		return nil, nil, err
+	}
+	return t, packet, nil
+}
+
+// checkSource verifies that the peer is allowed to send a decrypted inner packet.
+func (d *Device) checkSource(t *Tunnel, packet []byte) error {
+	if len(packet) == 0 {
+		return nil
+	}
+
+	inner, err := PacketSource(packet)
+	if err != nil {
+		return err
+	}
+	if d.AllowedIPs.Lookup(inner) != t {
+		return errors.New("source address is not allowed for the peer")
+	}
+	return nil
+}
+
+// LookupDestination finds the peer an outbound inner packet should be sent to.
+func (d *Device) LookupDestination(packet []byte) (*Tunnel, error) {
+	dst, err := PacketDestination(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	t := d.AllowedIPs.Lookup(dst)
+	if t == nil {
+		return nil, errors.New("no route to the destination address")
+	}
+	return t, nil
+}
+
+// CreateTransportMessage routes an outbound inner packet to its peer and encrypts it.
+func (d *Device) CreateTransportMessage(packet []byte) (*Tunnel, MessageTransport, error) {
+	t, err := d.LookupDestination(packet)
+	if err != nil {
+		return nil, MessageTransport{}, err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	message, err := t.CreateTransportMessage(packet)
+	if err != nil {
+		return nil, MessageTransport{}, err
+	}
+	return t, message, nil
+}
+
+// ProcessInitiateHandshakeMessage identifies the initiator by its decrypted static key
+// and continues the handshake with the state of the matching peer.
+// The peer endpoint is updated to src once the initiation is authenticated.
+// An initiation whose timestamp can't be stored is rejected, leaving the handshake state unchanged.
+func (d *Device) ProcessInitiateHandshakeMessage(message MessageHandshakeInit, src netip.AddrPort) (*Tunnel, error) {
+	state, err := ConsumeInitiation(d.Identity(), message)
+	if err != nil {
+		d.Stats.handshakeFailed(err)
+		return nil, err
+	}
+
+	t := d.LookupPeer(state.Static)
+	if t == nil {
+		loggerOrDiscard(d.Logger).Debug("handshake initiation from an unknown peer", "peer", state.Static, "endpoint", src)
+		err := errors.New("unknown peer")
+		d.Stats.handshakeFailed(err)
+		return nil, err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	handshake, remoteID := t.Handshake, t.RemoteID
+	if err := t.ProcessInitiation(state, message); err != nil {
+		d.Stats.handshakeFailed(err)
+		return nil, err
+	}
+	if d.Timestamps != nil {
+		if err := d.Timestamps.Store(t.Remote.PublicKey, t.Handshake.LastTimestamp); err != nil {
+			t.Handshake, t.RemoteID = handshake, remoteID
+			d.Stats.handshakeFailed(err)
+			return nil, err
+		}
+	}
+	learnEndpoint(t, src)
+	return t, nil
+}
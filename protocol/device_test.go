@@ -0,0 +1,406 @@
+package protocol
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func newIdentity() Identity {
+	return NewIdentity(NewPrivateKey())
+}
+
+func Test_IndexTable_UniqueIndices(t *testing.T) {
+	var table IndexTable
+	tunnel := &Tunnel{}
+
+	seen := make(map[uint32]bool)
+	for i := 0; i < 1000; i++ {
+		id, err := table.NewIndex(tunnel)
+		assert.Nil(t, err)
+		assert.False(t, seen[id], "index %d allocated twice", id)
+		seen[id] = true
+	}
+	assert.Equal(t, 1000, table.Len())
+
+	for id := range seen {
+		assert.Equal(t, tunnel, table.Lookup(id))
+		table.Delete(id)
+		assert.Nil(t, table.Lookup(id))
+	}
+	assert.Equal(t, 0, table.Len())
+}
+
+func Test_Device_AddRemovePeer(t *testing.T) {
+	device := NewDevice(newIdentity().PrivateKey)
+	remote := newIdentity()
+
+	tunnel := device.AddPeer(Peer{PublicKey: remote.PublicKey})
+	assert.Equal(t, tunnel, device.AddPeer(Peer{PublicKey: remote.PublicKey}))
+	assert.Equal(t, tunnel, device.LookupPeer(remote.PublicKey))
+	assert.Len(t, device.Peers(), 1)
+
+	_, err := tunnel.InitiateHandshake()
+	assert.Nil(t, err)
+	assert.Equal(t, tunnel, device.Indices.Lookup(tunnel.LocalID))
+
+	device.RemovePeer(remote.PublicKey)
+	assert.Nil(t, device.LookupPeer(remote.PublicKey))
+	assert.Nil(t, device.Indices.Lookup(tunnel.LocalID))
+	assert.Empty(t, device.Peers())
+}
+
+func Test_Device_RoutesByReceiver(t *testing.T) {
+	server := newIdentity()
+	device := NewDevice(server.PrivateKey)
+
+	type client struct {
+		local  *Device
+		tunnel *Tunnel
+		remote *Tunnel
+	}
+
+	clients := make([]client, 0, 5)
+	for i := 0; i < 5; i++ {
+		identity := newIdentity()
+		local := NewDevice(identity.PrivateKey)
+		clients = append(clients, client{
+			local:  local,
+			tunnel: local.AddPeer(Peer{PublicKey: server.PublicKey}),
+			remote: device.AddPeer(Peer{PublicKey: identity.PublicKey}),
+		})
+	}
+
+	for _, c := range clients {
+		ih, err := c.tunnel.InitiateHandshake()
+		assert.Nil(t, err)
+		assert.Nil(t, c.remote.ProcessInitiateHandshakeMessage(ih))
+
+		rh, err := c.remote.CreateInitiateHandshakeResponse()
+		assert.Nil(t, err)
+		assert.Nil(t, c.remote.BeginSymmetricSession())
+
+		tunnel, err := c.local.ProcessInitiateHandshakeResponseMessage(rh, netip.AddrPort{})
+		assert.Nil(t, err)
+		assert.Equal(t, c.tunnel, tunnel)
+		assert.Nil(t, tunnel.BeginSymmetricSession())
+	}
+	assert.Equal(t, len(clients), device.Indices.Len())
+
+	for i, c := range clients {
+		src := netip.AddrFrom4([4]byte{10, 0, 0, byte(i + 2)})
+		device.AllowedIPs.Insert(netip.PrefixFrom(src, 32), c.remote)
+
+		packet := ipv4PacketFrom(src, netip.MustParseAddr("10.0.0.1"), "ping")
+		message, err := c.tunnel.CreateTransportMessage(packet)
+		assert.Nil(t, err)
+
+		tunnel, decrypted, err := device.ProcessTransportMessage(message, netip.AddrPort{})
+		assert.Nil(t, err)
+		assert.Equal(t, c.remote, tunnel)
+		assert.Equal(t, packet, decrypted)
+	}
+
+	_, _, err := device.ProcessTransportMessage(MessageTransport{Type: TransportType, Receiver: 0xdeadbeef ^ clients[0].remote.LocalID}, netip.AddrPort{})
+	assert.NotNil(t, err)
+}
+
+func Test_Device_UnexpectedHandshakeResponse(t *testing.T) {
+	device := NewDevice(newIdentity().PrivateKey)
+	tunnel := device.AddPeer(Peer{PublicKey: newIdentity().PublicKey})
+
+	assert.Nil(t, tunnel.newLocalID())
+
+	_, err := device.ProcessInitiateHandshakeResponseMessage(MessageHandshakeResponse{
+		Type:     HandshakeResponseType,
+		Receiver: tunnel.LocalID,
+	}, netip.AddrPort{})
+	assert.NotNil(t, err)
+}
+
+func Test_Device_IdentifiesInitiatorByStaticKey(t *testing.T) {
+	server := newIdentity()
+	device := NewDevice(server.PrivateKey)
+
+	first, second := newIdentity(), newIdentity()
+	firstRemote := device.AddPeer(Peer{PublicKey: first.PublicKey})
+	secondRemote := device.AddPeer(Peer{PublicKey: second.PublicKey})
+
+	for _, c := range []struct {
+		identity Identity
+		remote   *Tunnel
+	}{{second, secondRemote}, {first, firstRemote}} {
+		initiator := NewDevice(c.identity.PrivateKey).AddPeer(Peer{PublicKey: server.PublicKey})
+
+		ih, err := initiator.InitiateHandshake()
+		assert.Nil(t, err)
+
+		tunnel, err := device.ProcessInitiateHandshakeMessage(ih, netip.AddrPort{})
+		assert.Nil(t, err)
+		assert.Equal(t, c.remote, tunnel)
+		assert.Equal(t, initiator.Handshake.ChainKey, tunnel.Handshake.ChainKey)
+		assert.Equal(t, initiator.Handshake.Hash, tunnel.Handshake.Hash)
+	}
+}
+
+func Test_Device_RejectsUnknownInitiator(t *testing.T) {
+	server := newIdentity()
+	device := NewDevice(server.PrivateKey)
+	device.AddPeer(Peer{PublicKey: newIdentity().PublicKey})
+
+	stranger := NewDevice(newIdentity().PrivateKey).AddPeer(Peer{PublicKey: server.PublicKey})
+	ih, err := stranger.InitiateHandshake()
+	assert.Nil(t, err)
+
+	_, err = device.ProcessInitiateHandshakeMessage(ih, netip.AddrPort{})
+	assert.NotNil(t, err)
+}
+
+func Test_Device_CryptokeyRouting(t *testing.T) {
+	server := newIdentity()
+	device := NewDevice(server.PrivateKey)
+
+	alice, bob := newIdentity(), newIdentity()
+	aliceRemote := device.AddPeer(Peer{PublicKey: alice.PublicKey})
+	bobRemote := device.AddPeer(Peer{PublicKey: bob.PublicKey})
+	device.AllowedIPs.Insert(netip.MustParsePrefix("10.0.0.2/32"), aliceRemote)
+	device.AllowedIPs.Insert(netip.MustParsePrefix("10.0.1.0/24"), bobRemote)
+	device.AllowedIPs.Insert(netip.MustParsePrefix("fd00::/64"), bobRemote)
+
+	server4 := netip.MustParseAddr("10.0.0.1")
+
+	t.Log("Outbound packets are routed by their destination")
+	{
+		tunnel, err := device.LookupDestination(ipv4PacketFrom(server4, netip.MustParseAddr("10.0.0.2"), "to alice"))
+		assert.Nil(t, err)
+		assert.Equal(t, aliceRemote, tunnel)
+
+		tunnel, err = device.LookupDestination(ipv4PacketFrom(server4, netip.MustParseAddr("10.0.1.77"), "to bob"))
+		assert.Nil(t, err)
+		assert.Equal(t, bobRemote, tunnel)
+
+		tunnel, err = device.LookupDestination(ipv6PacketFrom(netip.MustParseAddr("fd00::1"), netip.MustParseAddr("fd00::2"), "to bob"))
+		assert.Nil(t, err)
+		assert.Equal(t, bobRemote, tunnel)
+
+		_, err = device.LookupDestination(ipv4PacketFrom(server4, netip.MustParseAddr("8.8.8.8"), "nowhere"))
+		assert.NotNil(t, err)
+	}
+
+	t.Log("Inbound packets are accepted only from allowed source addresses")
+	{
+		initiator := NewDevice(alice.PrivateKey).AddPeer(Peer{PublicKey: server.PublicKey})
+		ih, err := initiator.InitiateHandshake()
+		assert.Nil(t, err)
+		_, err = device.ProcessInitiateHandshakeMessage(ih, netip.AddrPort{})
+		assert.Nil(t, err)
+		rh, err := aliceRemote.CreateInitiateHandshakeResponse()
+		assert.Nil(t, err)
+		assert.Nil(t, aliceRemote.BeginSymmetricSession())
+		assert.Nil(t, initiator.ProcessInitiateHandshakeResponseMessage(rh))
+		assert.Nil(t, initiator.BeginSymmetricSession())
+
+		message, err := initiator.CreateTransportMessage(ipv4PacketFrom(netip.MustParseAddr("10.0.0.2"), server4, "legit"))
+		assert.Nil(t, err)
+		tunnel, _, err := device.ProcessTransportMessage(message, netip.AddrPort{})
+		assert.Nil(t, err)
+		assert.Equal(t, aliceRemote, tunnel)
+
+		message, err = initiator.CreateTransportMessage(ipv4PacketFrom(netip.MustParseAddr("10.0.1.5"), server4, "spoofed"))
+		assert.Nil(t, err)
+		_, _, err = device.ProcessTransportMessage(message, netip.AddrPort{})
+		assert.NotNil(t, err, "alice can't send packets from bob's addresses")
+
+		message, err = initiator.CreateKeepaliveMessage()
+		assert.Nil(t, err)
+		_, packet, err := device.ProcessTransportMessage(message, netip.AddrPort{})
+		assert.Nil(t, err, "keepalives carry no source address")
+		assert.Empty(t, packet)
+	}
+
+	t.Log("Removing a peer removes its routes")
+	{
+		device.RemovePeer(bob.PublicKey)
+		assert.Nil(t, device.AllowedIPs.Lookup(netip.MustParseAddr("10.0.1.77")))
+		assert.Equal(t, aliceRemote, device.AllowedIPs.Lookup(netip.MustParseAddr("10.0.0.2")))
+	}
+}
+
+func Test_Device_EndpointRoaming(t *testing.T) {
+	server := newIdentity()
+	device := NewDevice(server.PrivateKey)
+	client := newIdentity()
+
+	remote := device.AddPeer(Peer{PublicKey: client.PublicKey})
+	clientDevice := NewDevice(client.PrivateKey)
+	initiator := clientDevice.AddPeer(Peer{PublicKey: server.PublicKey})
+
+	serverAddr := netip.MustParseAddrPort("198.51.100.1:51820")
+	home := netip.MustParseAddrPort("192.0.2.1:51820")
+	mobile := netip.MustParseAddrPort("[2001:db8::1]:40000")
+	attacker := netip.MustParseAddrPort("203.0.113.66:666")
+
+	ih, err := initiator.InitiateHandshake()
+	assert.Nil(t, err)
+
+	forged := ih
+	forged.Static[0] ^= 1
+	_, err = device.ProcessInitiateHandshakeMessage(forged, attacker)
+	assert.NotNil(t, err)
+	assert.False(t, remote.Endpoint.IsValid(), "unauthenticated initiations don't set the endpoint")
+
+	_, err = device.ProcessInitiateHandshakeMessage(ih, netip.MustParseAddrPort("[::ffff:192.0.2.1]:51820"))
+	assert.Nil(t, err)
+	assert.Equal(t, home, remote.Endpoint, "IPv4-mapped addresses are unmapped")
+
+	rh, err := remote.CreateInitiateHandshakeResponse()
+	assert.Nil(t, err)
+	assert.Nil(t, remote.BeginSymmetricSession())
+	_, err = clientDevice.ProcessInitiateHandshakeResponseMessage(rh, serverAddr)
+	assert.Nil(t, err)
+	assert.Nil(t, initiator.BeginSymmetricSession())
+	assert.Equal(t, serverAddr, initiator.Endpoint)
+
+	message, err := initiator.CreateKeepaliveMessage()
+	assert.Nil(t, err)
+	_, _, err = device.ProcessTransportMessage(message, mobile)
+	assert.Nil(t, err)
+	assert.Equal(t, mobile, remote.Endpoint, "the endpoint follows authenticated transport messages")
+
+	_, _, err = device.ProcessTransportMessage(message, attacker)
+	assert.NotNil(t, err)
+	assert.Equal(t, mobile, remote.Endpoint, "replayed messages don't move the endpoint")
+
+	message, err = initiator.CreateKeepaliveMessage()
+	assert.Nil(t, err)
+	message.Packet[0] ^= 1
+	_, _, err = device.ProcessTransportMessage(message, attacker)
+	assert.NotNil(t, err)
+	assert.Equal(t, mobile, remote.Endpoint, "tampered messages don't move the endpoint")
+}
+
+func Test_Device_SetPrivateKey(t *testing.T) {
+	server := newIdentity()
+	device := NewDevice(server.PrivateKey)
+	client := newIdentity()
+
+	remote := device.AddPeer(Peer{PublicKey: client.PublicKey})
+	initiator := NewDevice(client.PrivateKey).AddPeer(Peer{PublicKey: server.PublicKey})
+	handshake(t, initiator, remote)
+	confirmSession(t, initiator, remote)
+	assert.Equal(t, uint64(MessageTransportHeaderSize+16), remote.RxBytes)
+
+	replacement := newIdentity()
+	device.AddPeer(Peer{PublicKey: replacement.PublicKey})
+	device.SetPrivateKey(replacement.PrivateKey)
+
+	assert.Equal(t, replacement, device.Identity())
+	assert.Nil(t, device.LookupPeer(replacement.PublicKey), "the device can't be its own peer")
+	assert.Equal(t, Keypairs{}, remote.Keypairs, "sessions of the old identity are dropped")
+
+	// Handshakes with the old identity fail, while the new one is accepted
+	ih, err := initiator.InitiateHandshake()
+	assert.Nil(t, err)
+	_, err = device.ProcessInitiateHandshakeMessage(ih, netip.AddrPort{})
+	assert.NotNil(t, err)
+
+	initiator = NewDevice(client.PrivateKey).AddPeer(Peer{PublicKey: replacement.PublicKey})
+	handshake(t, initiator, remote)
+	confirmSession(t, initiator, remote)
+}
+
+type memoryTimestamps map[PublicKey]Tai64n
+
+func (m memoryTimestamps) Load(pk PublicKey) (Tai64n, bool) {
+	ts, ok := m[pk]
+	return ts, ok
+}
+
+func (m memoryTimestamps) Store(pk PublicKey, ts Tai64n) error {
+	m[pk] = ts
+	return nil
+}
+
+type failingTimestamps struct{}
+
+func (failingTimestamps) Load(PublicKey) (Tai64n, bool) {
+	return Tai64n{}, false
+}
+
+func (failingTimestamps) Store(PublicKey, Tai64n) error {
+	return errors.New("disk is full")
+}
+
+func Test_Device_TimestampStoreFailure(t *testing.T) {
+	server := newIdentity()
+	client := newIdentity()
+
+	device := NewDevice(server.PrivateKey)
+	device.Timestamps = failingTimestamps{}
+	remote := device.AddPeer(Peer{PublicKey: client.PublicKey})
+	initiator := NewDevice(client.PrivateKey).AddPeer(Peer{PublicKey: server.PublicKey})
+
+	ih, err := initiator.InitiateHandshake()
+	assert.Nil(t, err)
+	_, err = device.ProcessInitiateHandshakeMessage(ih, netip.MustParseAddrPort("192.0.2.1:51820"))
+	assert.NotNil(t, err)
+
+	assert.Equal(t, Tai64n{}, remote.Handshake.LastTimestamp, "the rejected initiation isn't remembered")
+	assert.Equal(t, Created, remote.Handshake.Status)
+	assert.Zero(t, remote.RemoteID)
+	assert.False(t, remote.Endpoint.IsValid())
+}
+
+func Test_Device_ReplayedInitiation(t *testing.T) {
+	server := newIdentity()
+	client := newIdentity()
+	store := memoryTimestamps{}
+
+	device := NewDevice(server.PrivateKey)
+	device.Timestamps = store
+	device.AddPeer(Peer{PublicKey: client.PublicKey})
+	initiator := NewDevice(client.PrivateKey).AddPeer(Peer{PublicKey: server.PublicKey})
+
+	ih, err := initiator.InitiateHandshake()
+	assert.Nil(t, err)
+
+	_, err = device.ProcessInitiateHandshakeMessage(ih, netip.AddrPort{})
+	assert.Nil(t, err)
+	assert.Contains(t, store, client.PublicKey)
+
+	_, err = device.ProcessInitiateHandshakeMessage(ih, netip.AddrPort{})
+	assert.ErrorIs(t, err, ErrStaleTimestamp)
+
+	// A restarted device loads the timestamp and keeps rejecting the captured initiation
+	restarted := NewDevice(server.PrivateKey)
+	restarted.Timestamps = store
+	restarted.AddPeer(Peer{PublicKey: client.PublicKey})
+
+	_, err = restarted.ProcessInitiateHandshakeMessage(ih, netip.AddrPort{})
+	assert.ErrorIs(t, err, ErrStaleTimestamp)
+
+	time.Sleep(TimestampResolution)
+	ih, err = initiator.InitiateHandshake()
+	assert.Nil(t, err)
+	_, err = restarted.ProcessInitiateHandshakeMessage(ih, netip.AddrPort{})
+	assert.Nil(t, err)
+}
+
+func Test_Device_OnPeerAdded(t *testing.T) {
+	device := NewDevice(NewPrivateKey())
+
+	var configured *Tunnel
+	device.OnPeerAdded = func(tunnel *Tunnel) {
+		assert.False(t, tunnel.Timers.running, "the timers start once configured")
+		tunnel.Timers.PersistentKeepaliveInterval = 25 * time.Second
+		configured = tunnel
+	}
+
+	tunnel := device.AddPeer(Peer{PublicKey: newIdentity().PublicKey})
+	assert.Same(t, tunnel, configured)
+	assert.True(t, tunnel.Timers.running)
+	assert.Equal(t, 25*time.Second, tunnel.Timers.PersistentKeepalive())
+	device.RemovePeer(tunnel.Remote.PublicKey)
+}
@@ -0,0 +1,62 @@
+package protocol
+
+import (
+	"errors"
+	"sync"
+)
+
+const maxIndexAttempts = 64
+
+// IndexTable keeps track of the local indices handed out to remote peers,
+// so that incoming messages could be routed by their Receiver field.
+type IndexTable struct {
+	mu    sync.RWMutex
+	table map[uint32]*Tunnel
+}
+
+// NewIndex allocates a random index which is not used by any other tunnel.
+func (it *IndexTable) NewIndex(t *Tunnel) (uint32, error) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	if it.table == nil {
+		it.table = make(map[uint32]*Tunnel)
+	}
+
+	for i := 0; i < maxIndexAttempts; i++ {
+		id, err := RandomUint32()
+		if err != nil {
+			return 0, err
+		}
+
+		if _, ok := it.table[id]; ok {
+			continue
+		}
+
+		it.table[id] = t
+		return id, nil
+	}
+
+	return 0, errors.New("failed to allocate a unique index")
+}
+
+func (it *IndexTable) Delete(id uint32) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	delete(it.table, id)
+}
+
+func (it *IndexTable) Lookup(id uint32) *Tunnel {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+
+	return it.table[id]
+}
+
+func (it *IndexTable) Len() int {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+
+	return len(it.table)
+}
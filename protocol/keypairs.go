@@ -0,0 +1,79 @@
+package protocol
+
+// rotateKeypairs installs a freshly derived keypair, following 6.3 of the whitepaper.
+//
+// The initiator starts using the new keypair immediately, keeping the old one as previous.
+// The responder may not send with the new keypair until the initiator has used it,
+// so the keypair waits in the next slot until the first transport message arrives.
+func (t *Tunnel) rotateKeypairs(keypair *Keypair) {
+	kp := &t.Keypairs
+
+	if keypair.IsInitiator {
+		if kp.Next != nil {
+			// An unconfirmed session takes precedence over the current one
+			t.dropKeypair(&kp.Previous)
+			kp.Previous, kp.Next = kp.Next, nil
+			t.dropKeypair(&kp.Current)
+		} else {
+			t.dropKeypair(&kp.Previous)
+			kp.Previous, kp.Current = kp.Current, nil
+		}
+		kp.Current = keypair
+		t.KeypairRotations++
+		return
+	}
+
+	t.dropKeypair(&kp.Next)
+	t.dropKeypair(&kp.Previous)
+	kp.Next = keypair
+}
+
+// confirmKeypair promotes the next keypair to current once
+// the responder received a transport message encrypted with it.
+func (t *Tunnel) confirmKeypair(keypair *Keypair) bool {
+	kp := &t.Keypairs
+	if kp.Next != keypair {
+		return false
+	}
+
+	t.dropKeypair(&kp.Previous)
+	kp.Previous, kp.Current, kp.Next = kp.Current, kp.Next, nil
+	t.KeypairRotations++
+	t.logger().Debug("session confirmed", "index", keypair.LocalID)
+	return true
+}
+
+// lookupKeypair finds the keypair a transport message was addressed to.
+func (t *Tunnel) lookupKeypair(receiver uint32) *Keypair {
+	for _, keypair := range []*Keypair{t.Keypairs.Current, t.Keypairs.Previous, t.Keypairs.Next} {
+		if keypair != nil && keypair.LocalID == receiver {
+			return keypair
+		}
+	}
+	return nil
+}
+
+// dropKeypair erases the keypair in the slot and releases its index.
+func (t *Tunnel) dropKeypair(slot **Keypair) {
+	keypair := *slot
+	if keypair == nil {
+		return
+	}
+	*slot = nil
+
+	keypair.SendKey = nil
+	keypair.ReceiveKey = nil
+	t.releaseIndex(keypair.LocalID)
+}
+
+// releaseIndex removes the index from the index table,
+// unless it is still used by the handshake or one of the keypairs.
+func (t *Tunnel) releaseIndex(id uint32) {
+	if t.Indices == nil || t.LocalID == id || t.lookupKeypair(id) != nil {
+		return
+	}
+
+	if t.Indices.Lookup(id) == t {
+		t.Indices.Delete(id)
+	}
+}
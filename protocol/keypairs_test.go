@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func handshake(t testing.TB, initiator, responder *Tunnel) {
+	// A responder accepts an initiation only with a timestamp newer than the previous one
+	time.Sleep(TimestampResolution)
+
+	ih, err := initiator.InitiateHandshake()
+	assert.Nil(t, err)
+	assert.Nil(t, responder.ProcessInitiateHandshakeMessage(ih))
+
+	rh, err := responder.CreateInitiateHandshakeResponse()
+	assert.Nil(t, err)
+	assert.Nil(t, responder.BeginSymmetricSession())
+
+	assert.Nil(t, initiator.ProcessInitiateHandshakeResponseMessage(rh))
+	assert.Nil(t, initiator.BeginSymmetricSession())
+}
+
+func Test_Keypairs_ResponderWaitsForConfirmation(t *testing.T) {
+	initiator, responder := newSession(t)
+
+	assert.NotNil(t, initiator.Keypairs.Current)
+	assert.Nil(t, responder.Keypairs.Current)
+	assert.NotNil(t, responder.Keypairs.Next)
+
+	_, err := responder.CreateKeepaliveMessage()
+	assert.NotNil(t, err, "responder can't send before the session is confirmed")
+
+	next := responder.Keypairs.Next
+	message, err := initiator.CreateKeepaliveMessage()
+	assert.Nil(t, err)
+	_, err = responder.ProcessTransportMessage(message)
+	assert.Nil(t, err)
+
+	assert.Equal(t, next, responder.Keypairs.Current)
+	assert.Nil(t, responder.Keypairs.Next)
+
+	_, err = responder.CreateKeepaliveMessage()
+	assert.Nil(t, err)
+}
+
+func Test_Keypairs_InFlightPacketsSurviveRekey(t *testing.T) {
+	initiator, responder := newSession(t)
+	confirmSession(t, initiator, responder)
+
+	fromInitiator, err := initiator.CreateTransportMessage(ipv4Packet("old session i-r"))
+	assert.Nil(t, err)
+	fromResponder, err := responder.CreateTransportMessage(ipv4Packet("old session r-i"))
+	assert.Nil(t, err)
+
+	old := initiator.Keypairs.Current
+	handshake(t, initiator, responder)
+
+	assert.Equal(t, old, initiator.Keypairs.Previous)
+	assert.NotEqual(t, old, initiator.Keypairs.Current)
+
+	// Packets sent with the old keypair are still accepted on both sides
+	packet, err := initiator.ProcessTransportMessage(fromResponder)
+	assert.Nil(t, err)
+	assert.Equal(t, ipv4Packet("old session r-i"), packet)
+
+	packet, err = responder.ProcessTransportMessage(fromInitiator)
+	assert.Nil(t, err)
+	assert.Equal(t, ipv4Packet("old session i-r"), packet)
+
+	// The responder keeps sending with the old keypair until the new one is confirmed
+	message, err := responder.CreateKeepaliveMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, old.LocalID, message.Receiver)
+
+	confirmSession(t, initiator, responder)
+
+	message, err = responder.CreateKeepaliveMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, initiator.Keypairs.Current.LocalID, message.Receiver)
+	assert.NotNil(t, responder.Keypairs.Previous)
+}
+
+func Test_Keypairs_OldKeysAreDropped(t *testing.T) {
+	server := newIdentity()
+	device := NewDevice(server.PrivateKey)
+	client := newIdentity()
+
+	responder := device.AddPeer(Peer{PublicKey: client.PublicKey})
+	initiator := NewDevice(client.PrivateKey).AddPeer(Peer{PublicKey: server.PublicKey})
+
+	var dropped []*Keypair
+	for i := 0; i < 4; i++ {
+		handshake(t, initiator, responder)
+		confirmSession(t, initiator, responder)
+		dropped = append(dropped, initiator.Keypairs.Current)
+	}
+
+	// Only the previous and current sessions are kept, along with their indices
+	assert.Equal(t, 2, device.Indices.Len())
+	for _, keypair := range dropped[:2] {
+		assert.Nil(t, keypair.SendKey)
+		assert.Nil(t, keypair.ReceiveKey)
+	}
+	assert.Equal(t, dropped[2], initiator.Keypairs.Previous)
+	assert.Equal(t, dropped[3], initiator.Keypairs.Current)
+
+	responder.ZeroKeyMaterial()
+	assert.Equal(t, Keypairs{}, responder.Keypairs)
+	assert.Equal(t, 0, device.Indices.Len())
+}
+
+func Test_Keypairs_UnknownReceiverRejected(t *testing.T) {
+	initiator, responder := newSession(t)
+
+	message, err := initiator.CreateKeepaliveMessage()
+	assert.Nil(t, err)
+
+	message.Receiver++
+	_, err = responder.ProcessTransportMessage(message)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// UnderLoadAfterTime is how long the device stays under load once the threshold was reached,
+	// so a flood can't toggle the mode on every other message.
+	UnderLoadAfterTime = time.Second
+
+	DefaultHandshakeLoadThreshold = 1024
+)
+
+// LoadMonitor counts incoming handshake messages per second
+// and reports whether their processing is saturated.
+type LoadMonitor struct {
+	Threshold int
+
+	mu             sync.Mutex
+	windowStart    time.Time
+	count          int
+	underLoadUntil time.Time
+}
+
+// Observe records an incoming handshake message and reports whether the device is under load.
+func (lm *LoadMonitor) Observe(now time.Time) bool {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	if now.Sub(lm.windowStart) >= time.Second {
+		lm.windowStart = now
+		lm.count = 0
+	}
+	lm.count++
+
+	if lm.count > lm.Threshold {
+		lm.underLoadUntil = now.Add(UnderLoadAfterTime)
+	}
+
+	return now.Before(lm.underLoadUntil)
+}
@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// discardHandler drops every record, it backs the logger of devices and tunnels which weren't given one.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var discardLogger = slog.New(discardHandler{})
+
+func loggerOrDiscard(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return discardLogger
+	}
+	return logger
+}
+
+// Fingerprint abbreviates the base64 encoding of the key, which is enough to tell the peers apart.
+func (pk PublicKey) Fingerprint() string {
+	encoded := pk.ToBase64()
+	return encoded[:4] + "…" + encoded[39:43]
+}
+
+// LogValue makes public keys appear in the logs as fingerprints.
+func (pk PublicKey) LogValue() slog.Value {
+	return slog.StringValue(pk.Fingerprint())
+}
+
+// Secrets never appear in the logs nor in formatted output, whatever the verb.
+// Marshalling them, as the JSON handler does for nested values, yields the same placeholder.
+// ToBase64 is the only way to encode them.
+const redacted = "[redacted]"
+
+var redactedText = []byte(redacted)
+var redactedJSON = []byte(`"` + redacted + `"`)
+
+func (sk PrivateKey) LogValue() slog.Value {
+	return slog.StringValue(redacted)
+}
+
+func (sk PrivateKey) Format(f fmt.State, verb rune) {
+	io.WriteString(f, redacted)
+}
+
+func (sk PrivateKey) MarshalText() ([]byte, error) {
+	return redactedText, nil
+}
+
+func (sk PrivateKey) MarshalJSON() ([]byte, error) {
+	return redactedJSON, nil
+}
+
+func (psk PresharedKey) LogValue() slog.Value {
+	return slog.StringValue(redacted)
+}
+
+func (psk PresharedKey) Format(f fmt.State, verb rune) {
+	io.WriteString(f, redacted)
+}
+
+func (psk PresharedKey) MarshalText() ([]byte, error) {
+	return redactedText, nil
+}
+
+func (psk PresharedKey) MarshalJSON() ([]byte, error) {
+	return redactedJSON, nil
+}
+
+func (ss SharedSecret) LogValue() slog.Value {
+	return slog.StringValue(redacted)
+}
+
+func (ss SharedSecret) Format(f fmt.State, verb rune) {
+	io.WriteString(f, redacted)
+}
+
+func (ss SharedSecret) MarshalText() ([]byte, error) {
+	return redactedText, nil
+}
+
+func (ss SharedSecret) MarshalJSON() ([]byte, error) {
+	return redactedJSON, nil
+}
@@ -0,0 +1,112 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// assertNoSecrets checks that none of the usual encodings of the secrets appears in the output.
+func assertNoSecrets(t *testing.T, output string, secrets ...[]byte) {
+	for _, secret := range secrets {
+		var sk PrivateKey
+		copy(sk[:], secret)
+
+		assert.NotContains(t, output, sk.ToBase64())
+		assert.NotContains(t, output, hex.EncodeToString(secret))
+		assert.NotContains(t, output, fmt.Sprint([]byte(secret)))
+		// encoding/json writes byte arrays as comma separated numbers
+		assert.NotContains(t, output, strings.ReplaceAll(fmt.Sprint([]byte(secret)), " ", ","))
+	}
+}
+
+func Test_Keys_Redacted(t *testing.T) {
+	identity := newIdentity()
+	psk := NewPresharedKey()
+	ss, err := identity.PrivateKey.SharedSecret(newIdentity().PublicKey)
+	assert.Nil(t, err)
+
+	var output strings.Builder
+	for _, verb := range []string{"%v", "%+v", "%#v", "%s", "%x", "%X", "%d", "%q"} {
+		fmt.Fprintf(&output, verb+"\n", identity)
+		fmt.Fprintf(&output, verb+"\n", psk)
+		fmt.Fprintf(&output, verb+"\n", ss)
+		fmt.Fprintf(&output, verb+"\n", Peer{PublicKey: identity.PublicKey, PresharedKey: psk})
+	}
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	logger.Info("keys", "identity", identity, "sk", identity.PrivateKey, "psk", psk, "ss", ss)
+	logger.Info("keys", "sk", &identity.PrivateKey, "psk", &psk)
+
+	assertNoSecrets(t, output.String()+logs.String(), identity.PrivateKey[:], psk[:], ss[:])
+	assert.Contains(t, output.String(), redacted)
+	assert.Contains(t, logs.String(), redacted)
+}
+
+func Test_Keys_RedactedInNestedJSON(t *testing.T) {
+	identity := newIdentity()
+	psk := NewPresharedKey()
+	device := NewDevice(identity.PrivateKey)
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	logger.Info("nested", "identity", identity, "local", device.Local, "peer", Peer{PresharedKey: psk})
+	logger.Info("nested", "keys", map[string]any{"sk": identity.PrivateKey, "psk": &psk})
+
+	assertNoSecrets(t, logs.String(), identity.PrivateKey[:], psk[:])
+	assert.Contains(t, logs.String(), `"PrivateKey":"[redacted]"`)
+	assert.Contains(t, logs.String(), `"PresharedKey":"[redacted]"`)
+}
+
+func Test_PublicKey_Fingerprint(t *testing.T) {
+	pk := PkFromString("pMo33VR8Lwi0nmi3sAFTFttomPI71LSMkEjFXws94wU=")
+	assert.Equal(t, "pMo3…94wU", pk.Fingerprint())
+
+	var logs bytes.Buffer
+	slog.New(slog.NewTextHandler(&logs, nil)).Info("handshake", "peer", pk)
+	assert.Contains(t, logs.String(), "peer=pMo3…94wU")
+}
+
+func Test_Device_LogsWithoutSecrets(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	server := newIdentity()
+	client := newIdentity()
+	psk := NewPresharedKey()
+
+	device := NewDevice(server.PrivateKey)
+	device.Logger = logger
+	remote := device.AddPeer(Peer{PublicKey: client.PublicKey, PresharedKey: psk})
+	clientDevice := NewDevice(client.PrivateKey)
+	clientDevice.Logger = logger
+	initiator := clientDevice.AddPeer(Peer{PublicKey: server.PublicKey, PresharedKey: psk})
+
+	ih, err := initiator.InitiateHandshake()
+	assert.Nil(t, err)
+	_, err = device.ProcessInitiateHandshakeMessage(ih, netip.MustParseAddrPort("192.0.2.1:51820"))
+	assert.Nil(t, err)
+	rh, err := remote.CreateInitiateHandshakeResponse()
+	assert.Nil(t, err)
+	assert.Nil(t, remote.BeginSymmetricSession())
+	_, err = clientDevice.ProcessInitiateHandshakeResponseMessage(rh, netip.MustParseAddrPort("198.51.100.1:51820"))
+	assert.Nil(t, err)
+	assert.Nil(t, initiator.BeginSymmetricSession())
+	confirmSession(t, initiator, remote)
+
+	device.SetPrivateKey(NewPrivateKey())
+	device.RemovePeer(client.PublicKey)
+
+	output := logs.String()
+	for _, message := range []string{"peer added", "endpoint changed", "session derived", "session confirmed", "private key changed", "peer removed"} {
+		assert.Contains(t, output, message)
+	}
+	assert.Contains(t, output, `"peer":"`+client.PublicKey.Fingerprint()+`"`)
+	assertNoSecrets(t, output, server.PrivateKey[:], client.PrivateKey[:], psk[:])
+}
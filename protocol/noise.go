@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"errors"
+	"fmt"
 	"golang.org/x/crypto/blake2s"
 	"golang.org/x/crypto/chacha20poly1305"
 	"time"
@@ -18,9 +19,13 @@ var (
 	InitialKeyChain [blake2s.Size]byte
 	InitialHash     [blake2s.Size]byte
 	ZeroNonce       [chacha20poly1305.NonceSize]byte
-	PreSharedKey    = [SharedSecretSize]byte{}
 	LabelMac1       = []byte(LabelMac1String)
 	LabelCookie     = []byte(LabelCookieString)
+
+	// ErrStaleTimestamp is returned for an initiation which isn't newer than the last one accepted from the peer.
+	ErrStaleTimestamp = errors.New("stale handshake timestamp")
+	// ErrHandshakeDecryption is returned for a handshake message whose encrypted fields fail authentication.
+	ErrHandshakeDecryption = errors.New("failed to decrypt the handshake message")
 )
 
 func init() {
@@ -39,13 +44,34 @@ func (t *Tunnel) Initialise() {
 	t.Handshake.PrecomputedStaticStatic, _ = t.Local.PrivateKey.SharedSecret(t.Remote.PublicKey)
 }
 
-func (t *Tunnel) InitiateHandshake() (MessageHandshakeInit, error) {
-	id, err := RandomUint32()
+// newLocalID replaces the local index of the tunnel,
+// registering it in the index table when the tunnel belongs to a device.
+func (t *Tunnel) newLocalID() error {
+	if t.Indices == nil {
+		id, err := RandomUint32()
+		if err != nil {
+			return err
+		}
+		t.LocalID = id
+		return nil
+	}
+
+	id, err := t.Indices.NewIndex(t)
 	if err != nil {
-		return MessageHandshakeInit{}, err
+		return err
 	}
 
+	previous := t.LocalID
 	t.LocalID = id
+	t.releaseIndex(previous)
+	return nil
+}
+
+func (t *Tunnel) InitiateHandshake() (MessageHandshakeInit, error) {
+	if err := t.newLocalID(); err != nil {
+		return MessageHandshakeInit{}, err
+	}
+
 	local, remote := t.Local, t.Remote
 
 	// 1-H H := HASH(C || Spubr)
@@ -94,61 +120,93 @@ func (t *Tunnel) InitiateHandshake() (MessageHandshakeInit, error) {
 	// 4-H H = HASH(H || msg.Timestamp)
 	HASH(&t.Handshake.Hash, t.Handshake.Hash[:], message.Timestamp[:])
 	t.Handshake.Status = InitiateHandshakeMessageSent
+	t.HandshakeAttempts++
+	t.Timers.HandshakeInitiated()
 	return message, nil
 }
 
-func (t *Tunnel) ProcessInitiateHandshakeMessage(message MessageHandshakeInit) error {
+// Initiation is the state of a responder after decrypting the initiator's static key,
+// when the initiator is known but its handshake message is not yet authenticated.
+type Initiation struct {
+	Hash     [blake2s.Size]byte
+	ChainKey [blake2s.Size]byte
+	Static   PublicKey
+}
 
-	var hash [blake2s.Size]byte
-	var chainKey [chacha20poly1305.KeySize]byte
+// ConsumeInitiation decrypts the static key of the initiator with the local identity of the responder.
+func ConsumeInitiation(local Identity, message MessageHandshakeInit) (Initiation, error) {
+	var state Initiation
 
 	// 1-H H := HASH(C || Spubr)
-	HASH(&hash, InitialHash[:], t.Local.PublicKey[:])
+	HASH(&state.Hash, InitialHash[:], local.PublicKey[:])
 
 	// 2-H H := HASH(H || Epubi)
-	HASH(&hash, hash[:], message.Ephemeral[:])
+	HASH(&state.Hash, state.Hash[:], message.Ephemeral[:])
 
 	// 1-C C := KDF1(C,Epubi)
-	KDF1(&chainKey, InitialKeyChain[:], message.Ephemeral[:])
+	KDF1(&state.ChainKey, InitialKeyChain[:], message.Ephemeral[:])
 
 	// se := DH(Sprivr, Epubi)
-	ss, err := t.Local.PrivateKey.SharedSecret(message.Ephemeral)
+	ss, err := local.PrivateKey.SharedSecret(message.Ephemeral)
 	if err != nil {
-		return err
+		return Initiation{}, err
 	}
 
 	var key [chacha20poly1305.KeySize]byte
 	// 2-C C, k := KDF2(C,DH(Sprivr, Epubi))
-	KDF2(&chainKey, &key, chainKey[:], ss[:])
+	KDF2(&state.ChainKey, &key, state.ChainKey[:], ss[:])
 
-	var pk PublicKey
 	aead, _ := chacha20poly1305.New(key[:])
-	_, err = aead.Open(pk[:], ZeroNonce[:], message.Static[:], hash[:])
+	_, err = aead.Open(state.Static[:0], ZeroNonce[:], message.Static[:], state.Hash[:])
 	if err != nil {
-		return errors.New("failed to decrypt the static key")
+		return Initiation{}, fmt.Errorf("%w: static key", ErrHandshakeDecryption)
 	}
 
 	// 3-H H := HASH(H || msg.Static)
-	HASH(&hash, hash[:], message.Static[:])
+	HASH(&state.Hash, state.Hash[:], message.Static[:])
+
+	return state, nil
+}
+
+func (t *Tunnel) ProcessInitiateHandshakeMessage(message MessageHandshakeInit) error {
+	state, err := ConsumeInitiation(t.Local, message)
+	if err != nil {
+		return err
+	}
+
+	if state.Static != t.Remote.PublicKey {
+		return errors.New("unknown static key")
+	}
+
+	return t.ProcessInitiation(state, message)
+}
+
+// ProcessInitiation completes processing of the handshake message
+// once the initiator has been identified by its static key.
+func (t *Tunnel) ProcessInitiation(state Initiation, message MessageHandshakeInit) error {
+	hash, chainKey := state.Hash, state.ChainKey
 
 	// Handshake.precomputedStaticStatic
-	ss, err = t.Local.PrivateKey.SharedSecret(t.Remote.PublicKey)
+	ss, err := t.Local.PrivateKey.SharedSecret(t.Remote.PublicKey)
 	if err != nil {
 		return err
 	}
 
+	var key [chacha20poly1305.KeySize]byte
 	// 3-C C, k := KDF2(C,DH(Sprivr, Spubi))
 	KDF2(&chainKey, &key, chainKey[:], ss[:])
 
 	var ts Tai64n
-	aead, _ = chacha20poly1305.New(key[:])
-	_, err = aead.Open(ts[:], ZeroNonce[:], message.Timestamp[:], hash[:])
+	aead, _ := chacha20poly1305.New(key[:])
+	_, err = aead.Open(ts[:0], ZeroNonce[:], message.Timestamp[:], hash[:])
 	if err != nil {
-		return errors.New("failed to decrypt the timestamp")
+		return fmt.Errorf("%w: timestamp", ErrHandshakeDecryption)
 	}
 
-	if ts.After(t.Handshake.LastTimestamp) {
-		return errors.New("timestamp is invalid")
+	// 5.1 of the whitepaper: a replayed initiation can't carry a newer timestamp
+	// than the last one accepted from the peer
+	if !ts.After(t.Handshake.LastTimestamp) {
+		return ErrStaleTimestamp
 	}
 
 	// 4-H H := HASH(H || msg.Timestamp)
@@ -168,13 +226,10 @@ func (t *Tunnel) ProcessInitiateHandshakeMessage(message MessageHandshakeInit) e
 func (t *Tunnel) CreateInitiateHandshakeResponse() (MessageHandshakeResponse, error) {
 	remote := t.Remote
 
-	id, err := RandomUint32()
-	if err != nil {
+	if err := t.newLocalID(); err != nil {
 		return MessageHandshakeResponse{}, err
 	}
 
-	t.LocalID = id
-
 	var hash [blake2s.Size]byte
 	var chainKey [chacha20poly1305.KeySize]byte
 
@@ -204,7 +259,7 @@ func (t *Tunnel) CreateInitiateHandshakeResponse() (MessageHandshakeResponse, er
 
 	var tau [blake2s.Size]byte
 	var key [chacha20poly1305.KeySize]byte
-	KDF3(&chainKey, &tau, &key, chainKey[:], PreSharedKey[:])
+	KDF3(&chainKey, &tau, &key, chainKey[:], t.Remote.PresharedKey[:])
 
 	HASH(&hash, hash[:], tau[:])
 	aead, _ := chacha20poly1305.New(key[:])
@@ -220,7 +275,6 @@ func (t *Tunnel) CreateInitiateHandshakeResponse() (MessageHandshakeResponse, er
 
 func (t *Tunnel) ProcessInitiateHandshakeResponseMessage(message MessageHandshakeResponse) error {
 	local, _ := t.Local, t.Remote
-	t.RemoteID = t.Handshake.InitiatorIndex
 
 	var hash [blake2s.Size]byte
 	var chainKey [chacha20poly1305.KeySize]byte
@@ -248,7 +302,7 @@ func (t *Tunnel) ProcessInitiateHandshakeResponseMessage(message MessageHandshak
 	var tau [blake2s.Size]byte
 	var key [chacha20poly1305.KeySize]byte
 	// 4-C C, tau, k := KDF3(C, Q)
-	KDF3(&chainKey, &tau, &key, chainKey[:], PreSharedKey[:])
+	KDF3(&chainKey, &tau, &key, chainKey[:], t.Remote.PresharedKey[:])
 
 	// 2-H H := HASH(H || tau)
 	HASH(&hash, hash[:], tau[:])
@@ -256,13 +310,14 @@ func (t *Tunnel) ProcessInitiateHandshakeResponseMessage(message MessageHandshak
 	aead, _ := chacha20poly1305.New(key[:])
 	_, err = aead.Open(nil, ZeroNonce[:], message.Empty[:], hash[:])
 	if err != nil {
-		return errors.New("failed to open the msg.empty field")
+		return fmt.Errorf("%w: empty field", ErrHandshakeDecryption)
 	}
 
 	HASH(&hash, hash[:], message.Empty[:])
 
 	t.Handshake.Hash = hash
 	t.Handshake.ChainKey = chainKey
+	t.RemoteID = message.Sender
 	t.Handshake.RemoteEphemeralPublic = message.Ephemeral
 	t.Handshake.Status = InitiateHandshakeResponseMessageReceived
 	return nil
@@ -272,7 +327,8 @@ func (t *Tunnel) BeginSymmetricSession() error {
 	var send [chacha20poly1305.KeySize]byte
 	var receive [chacha20poly1305.KeySize]byte
 
-	if t.Handshake.Status == InitiateHandshakeResponseMessageReceived {
+	isInitiator := t.Handshake.Status == InitiateHandshakeResponseMessageReceived
+	if isInitiator {
 		KDF2(&send, &receive, t.Handshake.ChainKey[:], nil)
 	} else if t.Handshake.Status == InitiateHandshakeResponseMessageSent {
 		KDF2(&receive, &send, t.Handshake.ChainKey[:], nil)
@@ -286,13 +342,46 @@ func (t *Tunnel) BeginSymmetricSession() error {
 	setZeroes(t.Handshake.LocalEphemeralPublic[:])
 	setZeroes(t.Handshake.RemoteEphemeralPublic[:])
 
-	t.Keypair = Keypair{}
-	t.Keypair.SendKey, _ = chacha20poly1305.New(send[:])
-	t.Keypair.ReceiveKey, _ = chacha20poly1305.New(receive[:])
-	t.Nonce = 0
+	keypair := &Keypair{
+		Created:     t.Timers.Now(),
+		IsInitiator: isInitiator,
+		LocalID:     t.LocalID,
+		RemoteID:    t.RemoteID,
+	}
+	keypair.SendKey, _ = chacha20poly1305.New(send[:])
+	keypair.ReceiveKey, _ = chacha20poly1305.New(receive[:])
+	setZeroes(send[:])
+	setZeroes(receive[:])
 
 	t.Handshake.Status = Completed
+	t.HandshakeSuccesses++
+	t.rotateKeypairs(keypair)
+	t.logger().Debug("session derived", "initiator", isInitiator, "index", keypair.LocalID)
+
+	// The responder's handshake is complete once the initiator
+	// confirms the session with its first transport message.
+	if isInitiator {
+		t.Timers.HandshakeComplete()
+	}
+	t.Timers.SessionDerived()
 
-	// Don't forget to keep track of prev keys to handle refreshes and reconnects.
 	return nil
 }
+
+// ZeroKeyMaterial erases the transport keys and any handshake in progress.
+func (t *Tunnel) ZeroKeyMaterial() {
+	setZeroes(t.Handshake.Hash[:])
+	setZeroes(t.Handshake.ChainKey[:])
+	setZeroes(t.Handshake.LocalEphemeralSecret[:])
+	setZeroes(t.Handshake.LocalEphemeralPublic[:])
+	setZeroes(t.Handshake.RemoteEphemeralPublic[:])
+
+	t.dropKeypair(&t.Keypairs.Previous)
+	t.dropKeypair(&t.Keypairs.Current)
+	t.dropKeypair(&t.Keypairs.Next)
+	t.Handshake.Status = Created
+
+	if t.Indices != nil && t.Indices.Lookup(t.LocalID) == t {
+		t.Indices.Delete(t.LocalID)
+	}
+}
@@ -13,13 +13,12 @@ func TestTunnel_ProcessInitiateHandshakeMessage(t *testing.T) {
 	_ = message.FromBytes(decodeString)
 
 	tunnel := Tunnel{
-		Local: Peer{
+		Local: Identity{
 			PublicKey:  PkFromString("pMo33VR8Lwi0nmi3sAFTFttomPI71LSMkEjFXws94wU="),
 			PrivateKey: SkFromString("WEGlnZqW7a3J+AmKoDg+/L95sSIutu9ApEp3AY+l30o="),
 		},
 		Remote: Peer{
-			PublicKey:  PkFromString("doQkpj/AjVrfbTFENyj46kzYWNDdrXulSfxBdnmslCo="),
-			PrivateKey: SkFromString("0Iic3DBj7LXp6dl+HKWT7a6/XXzRfqaDiZXArCpLQWE="),
+			PublicKey: PkFromString("doQkpj/AjVrfbTFENyj46kzYWNDdrXulSfxBdnmslCo="),
 		},
 		Handshake: Handshake{},
 	}
@@ -34,22 +33,20 @@ func Test_Handshake(t *testing.T) {
 	responderSK := NewPrivateKey()
 
 	initiator := Tunnel{
-		Local: Peer{
+		Local: Identity{
 			PrivateKey: initiatorSK,
 			PublicKey:  initiatorSK.PublicKey(),
 		},
 		Remote: Peer{
-			PrivateKey: responderSK,
-			PublicKey:  responderSK.PublicKey(),
+			PublicKey: responderSK.PublicKey(),
 		},
 		Handshake: Handshake{},
 	}
 	responder := Tunnel{
 		Remote: Peer{
-			PrivateKey: initiatorSK,
-			PublicKey:  initiatorSK.PublicKey(),
+			PublicKey: initiatorSK.PublicKey(),
 		},
-		Local: Peer{
+		Local: Identity{
 			PrivateKey: responderSK,
 			PublicKey:  responderSK.PublicKey(),
 		},
@@ -121,8 +118,8 @@ func Test_Handshake(t *testing.T) {
 
 		var sealed []byte
 		testData := []byte("hello world")
-		encrypted := initiator.Keypair.SendKey.Seal(sealed, ZeroNonce[:], testData, nil)
-		decrypted, err := responder.Keypair.ReceiveKey.Open(sealed[:], ZeroNonce[:], encrypted, nil)
+		encrypted := initiator.Keypairs.Current.SendKey.Seal(sealed, ZeroNonce[:], testData, nil)
+		decrypted, err := responder.Keypairs.Next.ReceiveKey.Open(sealed[:], ZeroNonce[:], encrypted, nil)
 
 		assert.Nil(t, err)
 		assert.Equal(t, testData, decrypted)
@@ -133,10 +130,82 @@ func Test_Handshake(t *testing.T) {
 
 		var sealed []byte
 		testData := []byte("hello world")
-		encrypted := responder.Keypair.SendKey.Seal(sealed, ZeroNonce[:], testData, nil)
-		decrypted, err := initiator.Keypair.ReceiveKey.Open(sealed[:], ZeroNonce[:], encrypted, nil)
+		encrypted := responder.Keypairs.Next.SendKey.Seal(sealed, ZeroNonce[:], testData, nil)
+		decrypted, err := initiator.Keypairs.Current.ReceiveKey.Open(sealed[:], ZeroNonce[:], encrypted, nil)
 
 		assert.Nil(t, err)
 		assert.Equal(t, testData, decrypted)
 	}
 }
+
+func TestTunnel_ProcessInitiateHandshakeMessage_UnknownStaticKey(t *testing.T) {
+	initiatorSK := NewPrivateKey()
+	responderSK := NewPrivateKey()
+	strangerSK := NewPrivateKey()
+
+	initiator := Tunnel{
+		Local:  NewIdentity(initiatorSK),
+		Remote: Peer{PublicKey: responderSK.PublicKey()},
+	}
+	responder := Tunnel{
+		Local:  NewIdentity(responderSK),
+		Remote: Peer{PublicKey: strangerSK.PublicKey()},
+	}
+	initiator.Initialise()
+	responder.Initialise()
+
+	ih, err := initiator.InitiateHandshake()
+	assert.Nil(t, err)
+
+	err = responder.ProcessInitiateHandshakeMessage(ih)
+	assert.NotNil(t, err)
+}
+
+func Test_Handshake_PresharedKey(t *testing.T) {
+	var psk PresharedKey
+	assert.Nil(t, psk.FromBase64("FpCyhws9cxwWoV4xELtfJvjJN+zQVRPISllRWgeopVE="))
+
+	initiatorSK := NewPrivateKey()
+	responderSK := NewPrivateKey()
+
+	newTunnels := func(initiatorPSK, responderPSK PresharedKey) (*Tunnel, *Tunnel) {
+		initiator := &Tunnel{
+			Local:  NewIdentity(initiatorSK),
+			Remote: Peer{PublicKey: responderSK.PublicKey(), PresharedKey: initiatorPSK},
+		}
+		responder := &Tunnel{
+			Local:  NewIdentity(responderSK),
+			Remote: Peer{PublicKey: initiatorSK.PublicKey(), PresharedKey: responderPSK},
+		}
+		initiator.Initialise()
+		responder.Initialise()
+		return initiator, responder
+	}
+
+	t.Log("Matching pre-shared keys")
+	{
+		initiator, responder := newTunnels(psk, psk)
+		handshake(t, initiator, responder)
+
+		message, err := initiator.CreateTransportMessage(ipv4Packet("psk"))
+		assert.Nil(t, err)
+		packet, err := responder.ProcessTransportMessage(message)
+		assert.Nil(t, err)
+		assert.Equal(t, ipv4Packet("psk"), packet)
+	}
+
+	t.Log("Mismatched pre-shared keys")
+	{
+		for _, keys := range [][2]PresharedKey{{psk, {}}, {{}, psk}} {
+			initiator, responder := newTunnels(keys[0], keys[1])
+
+			ih, err := initiator.InitiateHandshake()
+			assert.Nil(t, err)
+			assert.Nil(t, responder.ProcessInitiateHandshakeMessage(ih), "pre-shared key is not used in the first message")
+
+			rh, err := responder.CreateInitiateHandshakeResponse()
+			assert.Nil(t, err)
+			assert.NotNil(t, initiator.ProcessInitiateHandshakeResponseMessage(rh))
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/poly1305"
+)
+
+var (
+	ErrInvalidType     = errors.New("unknown message type")
+	ErrInvalidSize     = errors.New("invalid message size")
+	ErrReservedNotZero = errors.New("reserved bytes are not zero")
+)
+
+// MessageError describes a datagram rejected by the parser.
+// Err is one of ErrInvalidType, ErrInvalidSize or ErrReservedNotZero.
+type MessageError struct {
+	Type byte
+	Size int
+	Err  error
+}
+
+func (e *MessageError) Error() string {
+	return fmt.Sprintf("message of type %d and %d bytes: %v", e.Type, e.Size, e.Err)
+}
+
+func (e *MessageError) Unwrap() error {
+	return e.Err
+}
+
+// MessageTransportMinSize is the size of a keepalive, the shortest transport message.
+const MessageTransportMinSize = MessageTransportHeaderSize + poly1305.TagSize
+
+// checkMessage validates the header of a raw message of the expected type.
+// Handshake messages have an exact size, while transport messages carry a packet of any length.
+func checkMessage(src []byte, messageType byte) error {
+	if len(src) == 0 {
+		return &MessageError{Size: 0, Err: ErrInvalidSize}
+	}
+
+	if src[0] != messageType {
+		return &MessageError{Type: src[0], Size: len(src), Err: ErrInvalidType}
+	}
+
+	var valid bool
+	switch messageType {
+	case HandshakeInitType:
+		valid = len(src) == MessageHandshakeInitSize
+	case HandshakeResponseType:
+		valid = len(src) == MessageHandshakeResponseSize
+	case HandshakeCookieType:
+		valid = len(src) == MessageHandshakeCookieSize
+	case TransportType:
+		valid = len(src) >= MessageTransportMinSize
+	}
+	if !valid {
+		return &MessageError{Type: src[0], Size: len(src), Err: ErrInvalidSize}
+	}
+
+	if src[1]|src[2]|src[3] != 0 {
+		return &MessageError{Type: src[0], Size: len(src), Err: ErrReservedNotZero}
+	}
+	return nil
+}
+
+// ParseMessage classifies a raw datagram by its type and decodes it.
+// The packet of a transport message aliases data.
+func ParseMessage(data []byte) (Message, error) {
+	if len(data) == 0 {
+		return nil, &MessageError{Size: 0, Err: ErrInvalidSize}
+	}
+
+	var message Message
+	switch data[0] {
+	case HandshakeInitType:
+		message = &MessageHandshakeInit{}
+	case HandshakeResponseType:
+		message = &MessageHandshakeResponse{}
+	case HandshakeCookieType:
+		message = &MessageHandshakeCookie{}
+	case TransportType:
+		message = &MessageTransport{}
+	default:
+		return nil, &MessageError{Type: data[0], Size: len(data), Err: ErrInvalidType}
+	}
+
+	if err := message.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
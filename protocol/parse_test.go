@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func validMessages() [][]byte {
+	return [][]byte{
+		(&MessageHandshakeInit{Type: HandshakeInitType, Sender: 1}).ToBytes(),
+		(&MessageHandshakeResponse{Type: HandshakeResponseType, Sender: 1, Receiver: 2}).ToBytes(),
+		(&MessageHandshakeCookie{Type: HandshakeCookieType, Receiver: 1}).ToBytes(),
+		(&MessageTransport{Type: TransportType, Receiver: 1, Packet: make([]byte, 16)}).ToBytes(),
+	}
+}
+
+func Test_ParseMessage_ValidMessages(t *testing.T) {
+	for _, data := range validMessages() {
+		message, err := ParseMessage(data)
+		assert.Nil(t, err)
+		assert.Equal(t, data, message.ToBytes())
+	}
+}
+
+func Test_ParseMessage_InvalidMessages(t *testing.T) {
+	initiation := (&MessageHandshakeInit{Type: HandshakeInitType}).ToBytes()
+	reserved := (&MessageHandshakeResponse{Type: HandshakeResponseType}).ToBytes()
+	reserved[2] = 1
+	transport := make([]byte, MessageTransportMinSize-1)
+	transport[0] = TransportType
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"empty", nil, ErrInvalidSize},
+		{"unknown type", []byte{5, 0, 0, 0}, ErrInvalidType},
+		{"zero type", make([]byte, MessageHandshakeInitSize), ErrInvalidType},
+		{"short init", initiation[:MessageHandshakeInitSize-1], ErrInvalidSize},
+		{"oversized init", append(initiation, 0), ErrInvalidSize},
+		{"type only", []byte{HandshakeCookieType}, ErrInvalidSize},
+		{"short transport", transport, ErrInvalidSize},
+		{"reserved bytes", reserved, ErrReservedNotZero},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := ParseMessage(test.data)
+			assert.Nil(t, message)
+			assert.ErrorIs(t, err, test.err)
+
+			var messageError *MessageError
+			assert.True(t, errors.As(err, &messageError))
+			assert.Equal(t, len(test.data), messageError.Size)
+		})
+	}
+}
+
+func Test_MessageSerde_RejectsWrongType(t *testing.T) {
+	var message MessageHandshakeResponse
+	err := message.FromBytes((&MessageHandshakeCookie{Type: HandshakeCookieType}).ToBytes())
+	assert.ErrorIs(t, err, ErrInvalidType)
+}
+
+func FuzzParseMessage(f *testing.F) {
+	for _, data := range validMessages() {
+		f.Add(data)
+	}
+	f.Add([]byte{})
+	f.Add([]byte{TransportType, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		message, err := ParseMessage(data)
+		if err != nil {
+			var messageError *MessageError
+			if !errors.As(err, &messageError) {
+				t.Fatalf("untyped error %v", err)
+			}
+			return
+		}
+
+		if !bytes.Equal(data, message.ToBytes()) {
+			t.Fatalf("message doesn't encode back to the same bytes")
+		}
+	})
+}
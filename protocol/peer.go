@@ -3,6 +3,10 @@ package protocol
 import (
 	"crypto/cipher"
 	"golang.org/x/crypto/blake2s"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
 )
 
 const (
@@ -14,20 +18,49 @@ const (
 	Completed                                = iota
 )
 
-type Peer struct {
+// Identity is the static key pair of the local side of the tunnels.
+type Identity struct {
 	PrivateKey PrivateKey
 	PublicKey  PublicKey
 }
 
+// NewIdentity derives the public key from the private one,
+// a zero private key yields an empty identity.
+func NewIdentity(sk PrivateKey) Identity {
+	if sk == (PrivateKey{}) {
+		return Identity{}
+	}
+	return Identity{PrivateKey: sk, PublicKey: sk.PublicKey()}
+}
+
+// Peer is the public material of a remote peer, its private key is never known locally.
+type Peer struct {
+	PublicKey    PublicKey
+	PresharedKey PresharedKey
+}
+
+// Tunnel holds the state of a session with a single remote peer.
+// Its methods are not safe for concurrent use, callers are expected to hold the lock.
+// Endpoint is the UDP address the messages to the remote peer are sent to.
+// Logger carries the fingerprint of the remote peer.
 type Tunnel struct {
-	Local     Peer
+	sync.Mutex
+	Local     Identity
 	Remote    Peer
 	Handshake Handshake
-	Keypair   Keypair
-	Nonce     uint64
+	Keypairs  Keypairs
 	LocalID   uint32
 	RemoteID  uint32
 	Stamper   Stamper
+	Indices   *IndexTable
+	Timers    Timers
+	Endpoint  netip.AddrPort
+	Logger    *slog.Logger
+	TunnelStats
+}
+
+func (t *Tunnel) logger() *slog.Logger {
+	return loggerOrDiscard(t.Logger)
 }
 
 type Handshake struct {
@@ -44,6 +77,21 @@ type Handshake struct {
 }
 
 type Keypair struct {
-	SendKey    cipher.AEAD
-	ReceiveKey cipher.AEAD
+	SendKey     cipher.AEAD
+	ReceiveKey  cipher.AEAD
+	SendNonce   uint64
+	Replay      ReplayFilter
+	Created     time.Time
+	IsInitiator bool
+	LocalID     uint32
+	RemoteID    uint32
+}
+
+// Keypairs keeps the sessions of a tunnel across rekeys.
+// Current is used for sending, Previous still decrypts in-flight packets of the old session,
+// and Next is a session derived by the responder which isn't confirmed by the initiator yet.
+type Keypairs struct {
+	Previous *Keypair
+	Current  *Keypair
+	Next     *Keypair
 }
@@ -0,0 +1,400 @@
+package protocol
+
+import (
+	"errors"
+	"net/netip"
+	"runtime"
+	"sync"
+)
+
+const (
+	// PipelineQueueSize is the number of messages waiting for the workers, and for each peer queue.
+	PipelineQueueSize = 1024
+
+	// MaxStagedPackets is the number of outbound packets of a peer kept until it has a session.
+	MaxStagedPackets = 128
+
+	// MaxSendBatch is the number of datagrams of a peer handed to OnSend at once.
+	MaxSendBatch = 128
+)
+
+// Pipeline encrypts and decrypts transport messages on a pool of workers.
+// Every message is also queued on a queue of its peer, so the messages of a peer
+// are handed to OnSend and OnReceive in the order they entered the pipeline,
+// whatever the order the workers finish them in.
+//
+// The datagrams of a peer which are ready together are handed to OnSend as a batch, so they may be
+// written with a single syscall. They are counted as sent once OnSend returns without an error,
+// otherwise each of them is dropped.
+// The packets of a peer without a session are staged while the handshake is requested,
+// they are sent by SendStaged, or once a message is received from the peer.
+// Workers defaults to GOMAXPROCS. The callbacks are called from the peer queues,
+// the messages of different peers may be delivered concurrently.
+// The datagrams passed to OnSend and the packet passed to OnReceive are only valid
+// until the callback returns, as their buffers go back to Buffers. OnSend may use the spare
+// capacity of the datagrams, which is the rest of their buffers.
+type Pipeline struct {
+	Device  *Device
+	Workers int
+	Buffers BufferPool
+
+	OnSend    func(t *Tunnel, datagrams [][]byte) error
+	OnReceive func(t *Tunnel, packet []byte, src netip.AddrPort)
+	OnDrop    func(t *Tunnel, err error)
+
+	jobs    chan *transportJob
+	workers sync.WaitGroup
+	queues  sync.WaitGroup
+	sending sync.WaitGroup
+
+	mu      sync.Mutex
+	running bool
+	peers   map[peerQueueKey]*peerQueue
+	staged  map[*Tunnel][]stagedPacket
+}
+
+type peerQueueKey struct {
+	tunnel  *Tunnel
+	inbound bool
+}
+
+// peerQueue is started by the first message of the peer and stops once it is empty.
+// The counter of a message is reserved and the message is queued while mu is held,
+// so the messages of a peer are queued in the order of their counters.
+type peerQueue struct {
+	mu      sync.Mutex
+	jobs    chan *transportJob
+	pending int
+}
+
+// stagedPacket is an outbound packet which is prepared again once the peer has a session.
+type stagedPacket struct {
+	buffer  *MessageBuffer
+	prepare func() (*transportJob, error)
+}
+
+func (p *Pipeline) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.running {
+		return
+	}
+
+	workers := p.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	p.jobs = make(chan *transportJob, PipelineQueueSize)
+	p.peers = make(map[peerQueueKey]*peerQueue)
+	p.staged = make(map[*Tunnel][]stagedPacket)
+	p.running = true
+
+	for i := 0; i < workers; i++ {
+		p.workers.Add(1)
+		go p.work()
+	}
+}
+
+// Stop waits until the queued messages are delivered and stops the workers, the staged packets are dropped.
+func (p *Pipeline) Stop() {
+	p.mu.Lock()
+	if !p.running {
+		p.mu.Unlock()
+		return
+	}
+	p.running = false
+	p.mu.Unlock()
+
+	p.sending.Wait()
+	close(p.jobs)
+	p.workers.Wait()
+	p.queues.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for t, staged := range p.staged {
+		for _, packet := range staged {
+			p.Buffers.Put(packet.buffer)
+		}
+		delete(p.staged, t)
+	}
+}
+
+// Encrypt routes an outbound inner packet to its peer and queues it for encryption.
+// The packet is copied, so the buffer may be reused once Encrypt returns.
+func (p *Pipeline) Encrypt(packet []byte) error {
+	if len(packet) > MaxContentSize {
+		return errors.New("packet is too large")
+	}
+
+	buffer := p.Buffers.Get()
+	copy(buffer[MessageTransportOffsetContent:], packet)
+	return p.EncryptBuffer(buffer, len(packet))
+}
+
+// EncryptBuffer is Encrypt for an inner packet of the size read into the buffer at MessageTransportOffsetContent.
+// The packet is encrypted in place and the pipeline takes over the buffer, returning it to Buffers once it is sent.
+func (p *Pipeline) EncryptBuffer(buffer *MessageBuffer, size int) error {
+	if size > MaxContentSize {
+		p.Buffers.Put(buffer)
+		return errors.New("packet is too large")
+	}
+
+	content := buffer[MessageTransportOffsetContent:]
+	t, err := p.Device.LookupDestination(content[:size])
+	if err != nil {
+		p.Buffers.Put(buffer)
+		return err
+	}
+
+	return p.submit(t, false, buffer, func() (*transportJob, error) {
+		return t.prepareSend(content, size)
+	})
+}
+
+// Decrypt routes a transport message of the size received into the buffer to its peer and queues it for decryption.
+// The message is decrypted in place and the pipeline takes over the buffer, returning it to Buffers once it is delivered.
+func (p *Pipeline) Decrypt(buffer *MessageBuffer, size int, src netip.AddrPort) error {
+	var message MessageTransport
+	if err := message.Unmarshal(buffer[:size]); err != nil {
+		p.Buffers.Put(buffer)
+		return err
+	}
+
+	t, err := p.Device.lookupReceiver(message.Receiver)
+	if err != nil {
+		p.Buffers.Put(buffer)
+		return err
+	}
+
+	return p.submit(t, true, buffer, func() (*transportJob, error) {
+		job, err := t.prepareReceive(message)
+		if err != nil {
+			return nil, err
+		}
+		job.src = src
+		job.packet = message.Packet[:0]
+		return job, nil
+	})
+}
+
+// SendStaged queues the packets staged while the peer had no session, once a session is established.
+func (p *Pipeline) SendStaged(t *Tunnel) {
+	p.mu.Lock()
+	staged := p.staged[t]
+	delete(p.staged, t)
+	p.mu.Unlock()
+
+	for _, packet := range staged {
+		if err := p.submit(t, false, packet.buffer, packet.prepare); err != nil && p.OnDrop != nil {
+			p.OnDrop(t, err)
+		}
+	}
+}
+
+// stage keeps an outbound packet until the peer has a session, dropping the oldest one once there are too many.
+func (p *Pipeline) stage(t *Tunnel, packet stagedPacket) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.running {
+		p.Buffers.Put(packet.buffer)
+		return
+	}
+
+	staged := p.staged[t]
+	if len(staged) >= MaxStagedPackets {
+		p.Buffers.Put(staged[0].buffer)
+		staged = staged[1:]
+	}
+	p.staged[t] = append(staged, packet)
+}
+
+// submit prepares a job of the tunnel with prepare, which is called with the tunnel locked,
+// and queues it. The pipeline takes over the buffer, even if the job can't be prepared.
+// An outbound packet of a peer without a session is staged instead.
+func (p *Pipeline) submit(t *Tunnel, inbound bool, buffer *MessageBuffer, prepare func() (*transportJob, error)) error {
+	key := peerQueueKey{tunnel: t, inbound: inbound}
+
+	// A place on the peer queue is held first, so the queue doesn't stop while the job is prepared
+	p.mu.Lock()
+	if !p.running {
+		p.mu.Unlock()
+		p.Buffers.Put(buffer)
+		return errors.New("pipeline is stopped")
+	}
+
+	q := p.peers[key]
+	if q == nil {
+		q = &peerQueue{jobs: make(chan *transportJob, PipelineQueueSize)}
+		p.peers[key] = q
+
+		p.queues.Add(1)
+		go p.deliver(key, q)
+	}
+	q.pending++
+	p.sending.Add(1)
+	p.mu.Unlock()
+
+	defer p.sending.Done()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	t.Lock()
+	job, err := prepare()
+	t.Unlock()
+	if !inbound && errors.Is(err, ErrNoSession) {
+		p.release(key, q)
+		p.stage(t, stagedPacket{buffer: buffer, prepare: prepare})
+		return nil
+	}
+	if err != nil {
+		p.Buffers.Put(buffer)
+		p.release(key, q)
+		return err
+	}
+	job.buffer = buffer
+
+	// The peer queue goes first, so the job keeps its place even if the workers are busy
+	job.ready = make(chan struct{})
+	q.jobs <- job
+	p.jobs <- job
+	return nil
+}
+
+// release gives up a place held on the peer queue, stopping the queue if it was the last one.
+func (p *Pipeline) release(key peerQueueKey, q *peerQueue) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	q.pending--
+	if q.pending == 0 {
+		// Nothing else is queued, so the queue waits for a job which never comes
+		delete(p.peers, key)
+		close(q.jobs)
+	}
+}
+
+func (p *Pipeline) work() {
+	defer p.workers.Done()
+
+	for job := range p.jobs {
+		if job.inbound {
+			job.open()
+		} else {
+			job.seal()
+		}
+		close(job.ready)
+	}
+}
+
+// deliver completes the jobs of a peer in order, returning once the queue is empty.
+func (p *Pipeline) deliver(key peerQueueKey, q *peerQueue) {
+	defer p.queues.Done()
+
+	for job := range q.jobs {
+		<-job.ready
+		delivered := 1
+		if job.inbound {
+			p.complete(job)
+		} else {
+			batch := p.gather(q, job)
+			p.send(job.tunnel, batch)
+			delivered = len(batch)
+		}
+
+		p.mu.Lock()
+		q.pending -= delivered
+		if q.pending == 0 {
+			delete(p.peers, key)
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+	}
+}
+
+// gather batches the ready job with the outbound jobs queued behind it, up to MaxSendBatch of them.
+// The queued jobs are being encrypted already, so waiting for them doesn't hold the batch back for long.
+func (p *Pipeline) gather(q *peerQueue, job *transportJob) []*transportJob {
+	batch := []*transportJob{job}
+	for len(batch) < MaxSendBatch {
+		select {
+		case next, ok := <-q.jobs:
+			if !ok {
+				return batch
+			}
+			<-next.ready
+			batch = append(batch, next)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// send hands the sealed datagrams of the jobs to OnSend at once.
+func (p *Pipeline) send(t *Tunnel, batch []*transportJob) {
+	datagrams := make([][]byte, len(batch))
+	for i, job := range batch {
+		// The sealed packet already follows the header in the buffer
+		n, _ := job.message.MarshalTo(job.buffer[:])
+		datagrams[i] = job.buffer[:n]
+	}
+	defer func() {
+		for _, job := range batch {
+			p.Buffers.Put(job.buffer)
+		}
+	}()
+
+	if p.OnSend == nil {
+		return
+	}
+
+	if err := p.OnSend(t, datagrams); err != nil {
+		if p.OnDrop != nil {
+			for range datagrams {
+				p.OnDrop(t, err)
+			}
+		}
+		return
+	}
+
+	t.Lock()
+	for _, datagram := range datagrams {
+		t.CountSent(len(datagram))
+	}
+	t.Unlock()
+}
+
+func (p *Pipeline) complete(job *transportJob) {
+	t := job.tunnel
+	defer p.Buffers.Put(job.buffer)
+
+	t.Lock()
+	packet, err := t.completeReceive(job)
+	if err == nil {
+		learnEndpoint(t, job.src)
+	}
+	t.Unlock()
+
+	if err == nil {
+		err = p.Device.checkSource(t, packet)
+	}
+	if err != nil {
+		if p.OnDrop != nil {
+			p.OnDrop(t, err)
+		}
+		return
+	}
+
+	if p.OnReceive != nil {
+		p.OnReceive(t, packet, job.src)
+	}
+
+	// The responder may only send once the initiator used the session
+	p.SendStaged(t)
+}
@@ -0,0 +1,339 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newPipelineDevices creates two devices which are each other's peer,
+// routing 10.0.0.1 to the server and 10.0.0.2 to the client.
+func newPipelineDevices() (*Device, *Device) {
+	server := newIdentity()
+	client := newIdentity()
+
+	serverDevice := NewDevice(server.PrivateKey)
+	clientDevice := NewDevice(client.PrivateKey)
+	remote := serverDevice.AddPeer(Peer{PublicKey: client.PublicKey})
+	initiator := clientDevice.AddPeer(Peer{PublicKey: server.PublicKey})
+
+	serverDevice.AllowedIPs.Insert(netip.MustParsePrefix("10.0.0.2/32"), remote)
+	clientDevice.AllowedIPs.Insert(netip.MustParsePrefix("10.0.0.1/32"), initiator)
+	return serverDevice, clientDevice
+}
+
+// newPipelinePeers establishes a session between the devices of newPipelineDevices.
+func newPipelinePeers(t testing.TB) (*Device, *Device) {
+	serverDevice, clientDevice := newPipelineDevices()
+	initiator, remote := clientDevice.Peers()[0], serverDevice.Peers()[0]
+
+	handshake(t, initiator, remote)
+	confirmSession(t, initiator, remote)
+	return serverDevice, clientDevice
+}
+
+// collector gathers copies of whatever a pipeline delivers, as the buffers are reused.
+type collector struct {
+	mu        sync.Mutex
+	datagrams [][]byte
+	batches   []int
+	packets   [][]byte
+	drops     []error
+}
+
+func (c *collector) attach(p *Pipeline) {
+	p.OnSend = func(_ *Tunnel, datagrams [][]byte) error {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, datagram := range datagrams {
+			c.datagrams = append(c.datagrams, bytes.Clone(datagram))
+		}
+		c.batches = append(c.batches, len(datagrams))
+		return nil
+	}
+	p.OnReceive = func(_ *Tunnel, packet []byte, _ netip.AddrPort) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.packets = append(c.packets, bytes.Clone(packet))
+	}
+	p.OnDrop = func(_ *Tunnel, err error) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.drops = append(c.drops, err)
+	}
+}
+
+// decryptDatagram copies a datagram into a buffer of the pipeline and queues it for decryption.
+func decryptDatagram(p *Pipeline, datagram []byte, src netip.AddrPort) error {
+	buffer := p.Buffers.Get()
+	n := copy(buffer[:], datagram)
+	return p.Decrypt(buffer, n, src)
+}
+
+func Test_Pipeline_InOrderDelivery(t *testing.T) {
+	server, client := newPipelinePeers(t)
+	src := netip.MustParseAddr("10.0.0.2")
+	dst := netip.MustParseAddr("10.0.0.1")
+	endpoint := netip.MustParseAddrPort("192.0.2.2:51820")
+
+	var sent, received collector
+	encrypt := &Pipeline{Device: client, Workers: 8}
+	decrypt := &Pipeline{Device: server, Workers: 8}
+	sent.attach(encrypt)
+	received.attach(decrypt)
+	encrypt.Start()
+	decrypt.Start()
+
+	var packets [][]byte
+	for i := 0; i < 500; i++ {
+		packet := ipv4PacketFrom(src, dst, fmt.Sprintf("packet %d %s", i, make([]byte, i%100)))
+		packets = append(packets, packet)
+		assert.Nil(t, encrypt.Encrypt(packet))
+	}
+	encrypt.Stop()
+
+	assert.Len(t, sent.datagrams, len(packets))
+	for i, datagram := range sent.datagrams {
+		var message MessageTransport
+		assert.Nil(t, message.FromBytes(datagram))
+		assert.Equal(t, uint64(i+1), message.Counter, "the confirming keepalive used the first counter")
+		assert.Nil(t, decryptDatagram(decrypt, datagram, endpoint))
+	}
+	decrypt.Stop()
+
+	assert.Empty(t, received.drops)
+	assert.Equal(t, packets, received.packets)
+	assert.Equal(t, endpoint, server.Peers()[0].Endpoint)
+}
+
+func Test_Pipeline_ConcurrentEncryptKeepsCounterOrder(t *testing.T) {
+	_, client := newPipelinePeers(t)
+	packet := ipv4PacketFrom(netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1"), "concurrent")
+
+	var sent collector
+	encrypt := &Pipeline{Device: client, Workers: 4}
+	sent.attach(encrypt)
+	encrypt.Start()
+
+	var senders sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			for j := 0; j < 200; j++ {
+				assert.Nil(t, encrypt.Encrypt(packet))
+			}
+		}()
+	}
+	senders.Wait()
+	encrypt.Stop()
+
+	assert.Len(t, sent.datagrams, 8*200)
+	for i, datagram := range sent.datagrams {
+		var message MessageTransport
+		assert.Nil(t, message.FromBytes(datagram))
+		assert.Equal(t, uint64(i+1), message.Counter, "the datagrams of a peer are sent in counter order")
+	}
+}
+
+func Test_Pipeline_Drops(t *testing.T) {
+	server, client := newPipelinePeers(t)
+	clientPeer := client.Peers()[0]
+
+	var received collector
+	decrypt := &Pipeline{Device: server}
+	received.attach(decrypt)
+	decrypt.Start()
+
+	clientPeer.Lock()
+	message, err := clientPeer.CreateTransportMessage(ipv4PacketFrom(netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1"), "hello"))
+	clientPeer.Unlock()
+	assert.Nil(t, err)
+
+	tampered := message.ToBytes()
+	tampered[MessageTransportHeaderSize] ^= 0xff
+
+	// The client isn't allowed to use any other source address
+	clientPeer.Lock()
+	spoofed, err := clientPeer.CreateTransportMessage(ipv4PacketFrom(netip.MustParseAddr("10.0.0.3"), netip.MustParseAddr("10.0.0.1"), "hello"))
+	clientPeer.Unlock()
+	assert.Nil(t, err)
+
+	for _, datagram := range [][]byte{message.ToBytes(), message.ToBytes(), tampered, spoofed.ToBytes()} {
+		assert.Nil(t, decryptDatagram(decrypt, datagram, netip.AddrPort{}))
+	}
+	assert.NotNil(t, decryptDatagram(decrypt, message.ToBytes()[:MessageTransportMinSize-1], netip.AddrPort{}))
+
+	assert.NotNil(t, decrypt.Encrypt(ipv4PacketFrom(netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.9"), "no route")))
+
+	decrypt.Stop()
+	assert.Len(t, received.packets, 1)
+	assert.Len(t, received.drops, 3)
+
+	assert.NotNil(t, decryptDatagram(decrypt, message.ToBytes(), netip.AddrPort{}), "a stopped pipeline doesn't accept messages")
+}
+
+func Test_Pipeline_StagesPacketsWithoutSession(t *testing.T) {
+	server, client := newPipelineDevices()
+	serverPeer, clientPeer := server.Peers()[0], client.Peers()[0]
+	handshakes := 0
+	clientPeer.Timers.OnHandshake = func() { handshakes++ }
+
+	var sent, received collector
+	encrypt := &Pipeline{Device: client}
+	decrypt := &Pipeline{Device: server}
+	sent.attach(encrypt)
+	received.attach(decrypt)
+	encrypt.Start()
+	decrypt.Start()
+
+	var packets [][]byte
+	for i := 0; i <= MaxStagedPackets; i++ {
+		packet := ipv4PacketFrom(netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1"), fmt.Sprintf("staged %d", i))
+		packets = append(packets, packet)
+		assert.Nil(t, encrypt.Encrypt(packet))
+	}
+	assert.Equal(t, 1, handshakes, "the packets wait for the requested handshake")
+
+	// The responder stages its packets until the initiator uses the session
+	handshake(t, clientPeer, serverPeer)
+	assert.Nil(t, decrypt.Encrypt(ipv4PacketFrom(netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2"), "reply")))
+	assert.Empty(t, received.datagrams)
+
+	encrypt.SendStaged(clientPeer)
+	encrypt.Stop()
+	assert.Empty(t, sent.drops)
+	assert.Len(t, sent.datagrams, MaxStagedPackets, "the oldest packet makes room for the newest one")
+
+	for _, datagram := range sent.datagrams {
+		assert.Nil(t, decryptDatagram(decrypt, datagram, netip.AddrPort{}))
+	}
+	assert.Eventually(t, func() bool {
+		received.mu.Lock()
+		defer received.mu.Unlock()
+		return len(received.datagrams) == 1
+	}, time.Second, time.Millisecond, "the reply is sent once the session is confirmed")
+	decrypt.Stop()
+	assert.Empty(t, received.drops)
+	assert.Equal(t, packets[1:], received.packets)
+}
+
+func Test_Pipeline_BatchesReadyDatagrams(t *testing.T) {
+	_, client := newPipelinePeers(t)
+	clientPeer := client.Peers()[0]
+	packet := ipv4PacketFrom(netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1"), "batched")
+
+	var sent collector
+	encrypt := &Pipeline{Device: client}
+	sent.attach(encrypt)
+	collect := encrypt.OnSend
+	sending, release := make(chan struct{}), make(chan struct{})
+	encrypt.OnSend = func(t *Tunnel, datagrams [][]byte) error {
+		if len(sent.batches) == 0 {
+			close(sending)
+			<-release
+		}
+		return collect(t, datagrams)
+	}
+	encrypt.Start()
+
+	// The datagrams queued while the first one is being sent go out together
+	assert.Nil(t, encrypt.Encrypt(packet))
+	<-sending
+	for i := 0; i < MaxSendBatch+10; i++ {
+		assert.Nil(t, encrypt.Encrypt(packet))
+	}
+	close(release)
+	encrypt.Stop()
+
+	assert.Equal(t, []int{1, MaxSendBatch, 10}, sent.batches)
+	for i, datagram := range sent.datagrams {
+		var message MessageTransport
+		assert.Nil(t, message.FromBytes(datagram))
+		assert.Equal(t, uint64(i+1), message.Counter)
+	}
+
+	clientPeer.Lock()
+	defer clientPeer.Unlock()
+	assert.Equal(t, uint64(MaxSendBatch+11), clientPeer.TxPackets)
+}
+
+func Test_Pipeline_CountsSentDatagrams(t *testing.T) {
+	_, client := newPipelinePeers(t)
+	clientPeer := client.Peers()[0]
+	packet := ipv4PacketFrom(netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1"), "counted")
+
+	var sent collector
+	encrypt := &Pipeline{Device: client}
+	sent.attach(encrypt)
+	failed := errors.New("network is unreachable")
+	encrypt.OnSend = func(_ *Tunnel, datagrams [][]byte) error {
+		if len(sent.datagrams) > 0 {
+			return failed
+		}
+		sent.datagrams = append(sent.datagrams, bytes.Clone(datagrams[0]))
+		return nil
+	}
+	encrypt.Start()
+	assert.Nil(t, encrypt.Encrypt(packet))
+	encrypt.Stop()
+	encrypt.Start()
+	assert.Nil(t, encrypt.Encrypt(packet))
+	encrypt.Stop()
+
+	assert.Len(t, sent.datagrams, 1)
+	assert.Equal(t, []error{failed}, sent.drops)
+
+	clientPeer.Lock()
+	defer clientPeer.Unlock()
+	assert.Equal(t, uint64(1), clientPeer.TxPackets, "failed sends aren't counted")
+	assert.Equal(t, uint64(len(sent.datagrams[0])), clientPeer.TxBytes)
+}
+
+func Test_Pipeline_EncryptBufferInPlace(t *testing.T) {
+	_, client := newPipelinePeers(t)
+	packet := ipv4PacketFrom(netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1"), "in place")
+
+	encrypt := &Pipeline{Device: client}
+	buffer := encrypt.Buffers.Get()
+	n := copy(buffer[MessageTransportOffsetContent:], packet)
+
+	var datagram []byte
+	encrypt.OnSend = func(_ *Tunnel, sent [][]byte) error {
+		assert.Same(t, &buffer[0], &sent[0][0], "the header is written in front of the packet")
+		datagram = bytes.Clone(sent[0])
+		return nil
+	}
+	encrypt.Start()
+	assert.Nil(t, encrypt.EncryptBuffer(buffer, n))
+	assert.NotNil(t, encrypt.Encrypt(make([]byte, MaxContentSize+1)))
+	encrypt.Stop()
+
+	assert.Len(t, datagram, MessageTransportMinSize+paddedLength(len(packet)))
+	message, err := ParseMessage(datagram)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), message.(*MessageTransport).Counter)
+}
+
+func BenchmarkPipeline_Encrypt(b *testing.B) {
+	_, client := newPipelinePeers(b)
+	packet := ipv4PacketFrom(netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1"), string(make([]byte, 1400)))
+
+	encrypt := &Pipeline{Device: client}
+	encrypt.Start()
+
+	b.SetBytes(int64(len(packet)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := encrypt.Encrypt(packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+	encrypt.Stop()
+}
@@ -0,0 +1,58 @@
+package protocol
+
+// Anti-replay window as described in RFC 6479.
+// The bitmap is a ring of blocks; advancing the window clears
+// whole blocks instead of shifting the entire bitmap.
+const (
+	replayBlockBits  = 64
+	replayBlockMask  = replayBlockBits - 1
+	replayBlockShift = 6
+	replayRingBlocks = 64
+	replayRingMask   = replayRingBlocks - 1
+
+	ReplayWindowSize = (replayRingBlocks - 1) * replayBlockBits
+)
+
+type ReplayFilter struct {
+	last uint64
+	ring [replayRingBlocks]uint64
+}
+
+func (f *ReplayFilter) Reset() {
+	f.last = 0
+	f.ring[0] = 0
+}
+
+// ValidateCounter reports whether the counter has not been seen before
+// and is recent enough to fit into the window, marking it as seen.
+// Counters equal to or above limit are always rejected.
+func (f *ReplayFilter) ValidateCounter(counter, limit uint64) bool {
+	if counter >= limit {
+		return false
+	}
+
+	index := counter >> replayBlockShift
+
+	if counter > f.last {
+		current := f.last >> replayBlockShift
+		diff := index - current
+		if diff > replayRingBlocks {
+			diff = replayRingBlocks
+		}
+		for i := current + 1; i <= current+diff; i++ {
+			f.ring[i&replayRingMask] = 0
+		}
+		f.last = counter
+	} else if f.last-counter > ReplayWindowSize {
+		return false
+	}
+
+	index &= replayRingMask
+	bit := uint64(1) << (counter & replayBlockMask)
+	if f.ring[index]&bit != 0 {
+		return false
+	}
+	f.ring[index] |= bit
+
+	return true
+}
@@ -0,0 +1,125 @@
+package protocol
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const replayTestLimit = RejectAfterMessages
+
+func Test_ReplayFilter_Sequential(t *testing.T) {
+	var filter ReplayFilter
+
+	for counter := uint64(0); counter < 10*ReplayWindowSize; counter++ {
+		assert.True(t, filter.ValidateCounter(counter, replayTestLimit), "counter %d", counter)
+	}
+	for counter := uint64(0); counter < 10*ReplayWindowSize; counter++ {
+		assert.False(t, filter.ValidateCounter(counter, replayTestLimit), "counter %d", counter)
+	}
+}
+
+func Test_ReplayFilter_Duplicates(t *testing.T) {
+	var filter ReplayFilter
+
+	assert.True(t, filter.ValidateCounter(0, replayTestLimit))
+	assert.False(t, filter.ValidateCounter(0, replayTestLimit))
+
+	assert.True(t, filter.ValidateCounter(42, replayTestLimit))
+	assert.False(t, filter.ValidateCounter(42, replayTestLimit))
+
+	assert.True(t, filter.ValidateCounter(41, replayTestLimit))
+	assert.False(t, filter.ValidateCounter(41, replayTestLimit))
+}
+
+func Test_ReplayFilter_WindowEdges(t *testing.T) {
+	var filter ReplayFilter
+
+	last := uint64(3 * ReplayWindowSize)
+	assert.True(t, filter.ValidateCounter(last, replayTestLimit))
+
+	assert.True(t, filter.ValidateCounter(last-ReplayWindowSize, replayTestLimit), "oldest counter in window")
+	assert.False(t, filter.ValidateCounter(last-ReplayWindowSize-1, replayTestLimit), "counter behind the window")
+	assert.False(t, filter.ValidateCounter(0, replayTestLimit), "counter far behind the window")
+}
+
+func Test_ReplayFilter_OutOfOrderBurst(t *testing.T) {
+	var filter ReplayFilter
+
+	// A burst delivered in reverse order must be accepted once
+	for counter := uint64(1000); counter > 0; counter-- {
+		assert.True(t, filter.ValidateCounter(counter, replayTestLimit), "counter %d", counter)
+	}
+	assert.True(t, filter.ValidateCounter(0, replayTestLimit))
+
+	// Interleaved even/odd bursts
+	base := uint64(5000)
+	for counter := base; counter < base+500; counter += 2 {
+		assert.True(t, filter.ValidateCounter(counter, replayTestLimit), "counter %d", counter)
+	}
+	for counter := base + 1; counter < base+500; counter += 2 {
+		assert.True(t, filter.ValidateCounter(counter, replayTestLimit), "counter %d", counter)
+	}
+	for counter := base; counter < base+500; counter++ {
+		assert.False(t, filter.ValidateCounter(counter, replayTestLimit), "counter %d", counter)
+	}
+}
+
+func Test_ReplayFilter_RingWraparound(t *testing.T) {
+	var filter ReplayFilter
+
+	// Move through the ring several times, so blocks are reused
+	// and stale bits of the previous rounds must not leak through.
+	step := uint64(replayBlockBits*replayRingBlocks) + 1
+	for round := uint64(1); round <= 5; round++ {
+		counter := round * step
+		assert.True(t, filter.ValidateCounter(counter, replayTestLimit), "counter %d", counter)
+		assert.True(t, filter.ValidateCounter(counter-1, replayTestLimit), "counter %d", counter-1)
+		assert.False(t, filter.ValidateCounter(counter-step, replayTestLimit), "counter %d", counter-step)
+	}
+
+	// A jump larger than the window clears everything in the ring
+	var jump ReplayFilter
+	for counter := uint64(0); counter < ReplayWindowSize; counter++ {
+		jump.ValidateCounter(counter, replayTestLimit)
+	}
+	far := uint64(ReplayWindowSize) * 7
+	assert.True(t, jump.ValidateCounter(far, replayTestLimit))
+	for counter := far - ReplayWindowSize; counter < far; counter++ {
+		assert.True(t, jump.ValidateCounter(counter, replayTestLimit), "counter %d", counter)
+	}
+}
+
+func Test_ReplayFilter_Limit(t *testing.T) {
+	var filter ReplayFilter
+
+	assert.True(t, filter.ValidateCounter(RejectAfterMessages-1, replayTestLimit))
+	assert.False(t, filter.ValidateCounter(RejectAfterMessages, replayTestLimit))
+	assert.False(t, filter.ValidateCounter(1<<64-1, replayTestLimit))
+}
+
+func Test_ReplayFilter_Reset(t *testing.T) {
+	var filter ReplayFilter
+
+	assert.True(t, filter.ValidateCounter(7, replayTestLimit))
+	filter.Reset()
+	assert.True(t, filter.ValidateCounter(7, replayTestLimit))
+}
+
+func Test_TransportMessage_ReplayRejected(t *testing.T) {
+	initiator, responder := newSession(t)
+
+	first, err := initiator.CreateTransportMessage(ipv4Packet("first"))
+	assert.Nil(t, err)
+	second, err := initiator.CreateTransportMessage(ipv4Packet("second"))
+	assert.Nil(t, err)
+
+	_, err = responder.ProcessTransportMessage(second)
+	assert.Nil(t, err)
+	_, err = responder.ProcessTransportMessage(first)
+	assert.Nil(t, err, "reordered packets are accepted")
+
+	_, err = responder.ProcessTransportMessage(first)
+	assert.NotNil(t, err, "replayed packets are rejected")
+	_, err = responder.ProcessTransportMessage(second)
+	assert.NotNil(t, err, "replayed packets are rejected")
+}
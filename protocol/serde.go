@@ -1,7 +1,6 @@
 package protocol
 
 import (
-	"bytes"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
@@ -19,11 +18,31 @@ func (sk *PublicKey) FromBase64(str string) error {
 	return decodeFromBase64(sk[:], str)
 }
 
+func (psk *PresharedKey) FromBase64(str string) error {
+	return decodeFromBase64(psk[:], str)
+}
+
+// ToBase64 encodes the key the same way the wg tool does.
+func (sk PrivateKey) ToBase64() string {
+	return base64.StdEncoding.EncodeToString(sk[:])
+}
+
+func (pk PublicKey) ToBase64() string {
+	return base64.StdEncoding.EncodeToString(pk[:])
+}
+
+func (psk PresharedKey) ToBase64() string {
+	return base64.StdEncoding.EncodeToString(psk[:])
+}
+
 func decodeFromBase64(dst []byte, str string) error {
 	key, err := base64.StdEncoding.DecodeString(str)
 	if err != nil {
 		return err
 	}
+	if len(key) != len(dst) {
+		return errors.New("invalid key length")
+	}
 	copy(dst[:], key)
 
 	return nil
@@ -43,118 +62,195 @@ func SkFromString(key string) (priv PrivateKey) {
 	return
 }
 
+// Message is a wire message with fixed-offset encoding.
+// MarshalTo and Unmarshal don't allocate: MarshalTo writes into the caller's buffer,
+// and the transport packet returned by Unmarshal aliases the source buffer.
 type Message interface {
+	Size() int
+	MarshalTo(dst []byte) (int, error)
+	Unmarshal(src []byte) error
 	ToBytes() []byte
 	FromBytes([]byte) error
 }
 
-func (m *MessageHandshakeInit) ToBytes() []byte {
-	var buffer [MessageHandshakeInitSize]byte
+var errShortBuffer = errors.New("buffer is too small for the message")
 
-	writer := bytes.NewBuffer(buffer[:0])
-	err := binary.Write(writer, binary.LittleEndian, m)
-	if err != nil {
-		return nil
-	}
+func (m *MessageHandshakeInit) Size() int {
+	return MessageHandshakeInitSize
+}
 
-	return writer.Bytes()
+func (m *MessageHandshakeResponse) Size() int {
+	return MessageHandshakeResponseSize
 }
-func (m *MessageHandshakeResponse) ToBytes() []byte {
-	var buffer [MessageHandshakeCookieSize]byte
 
-	writer := bytes.NewBuffer(buffer[:0])
-	binary.Write(writer, binary.LittleEndian, m)
+func (m *MessageHandshakeCookie) Size() int {
+	return MessageHandshakeCookieSize
+}
 
-	return writer.Bytes()
+func (m *MessageTransport) Size() int {
+	return MessageTransportHeaderSize + len(m.Packet)
 }
-func (m *MessageHandshakeCookie) ToBytes() []byte {
-	var buffer [MessageHandshakeCookieSize]byte
 
-	writer := bytes.NewBuffer(buffer[:0])
-	binary.Write(writer, binary.LittleEndian, m)
+// MarshalTo encodes the message into dst, returning the number of bytes written.
+func (m *MessageHandshakeInit) MarshalTo(dst []byte) (int, error) {
+	if len(dst) < MessageHandshakeInitSize {
+		return 0, errShortBuffer
+	}
+
+	binary.LittleEndian.PutUint32(dst[0:4], m.Type)
+	binary.LittleEndian.PutUint32(dst[4:8], m.Sender)
+	copy(dst[8:40], m.Ephemeral[:])
+	copy(dst[40:88], m.Static[:])
+	copy(dst[88:116], m.Timestamp[:])
+	copy(dst[116:132], m.MAC1[:])
+	copy(dst[132:148], m.MAC2[:])
 
-	return writer.Bytes()
+	return MessageHandshakeInitSize, nil
 }
-func (m *MessageTransport) ToBytes() []byte {
-	buffer := make([]byte, MessageTransportHeaderSize+len(m.Packet))
 
-	binary.LittleEndian.PutUint32(buffer[0:], m.Type)
+func (m *MessageHandshakeResponse) MarshalTo(dst []byte) (int, error) {
+	if len(dst) < MessageHandshakeResponseSize {
+		return 0, errShortBuffer
+	}
 
-	// skipping 3 bytes of reserved space
-	l, r := UIntSize, 2*UIntSize
-	binary.LittleEndian.PutUint32(buffer[l:r], m.Receiver)
-	l, r = r, r+ULongSize
-	binary.LittleEndian.PutUint64(buffer[l:r], m.Counter)
+	binary.LittleEndian.PutUint32(dst[0:4], m.Type)
+	binary.LittleEndian.PutUint32(dst[4:8], m.Sender)
+	binary.LittleEndian.PutUint32(dst[8:12], m.Receiver)
+	copy(dst[12:44], m.Ephemeral[:])
+	copy(dst[44:60], m.Empty[:])
+	copy(dst[60:76], m.MAC1[:])
+	copy(dst[76:92], m.MAC2[:])
 
-	copy(buffer[r:], m.Packet)
-	return buffer
+	return MessageHandshakeResponseSize, nil
 }
 
-func (m *MessageHandshakeInit) FromBytes(data []byte) error {
-	if data[0] != HandshakeInitType {
-		return errors.New("invalid message type")
+func (m *MessageHandshakeCookie) MarshalTo(dst []byte) (int, error) {
+	if len(dst) < MessageHandshakeCookieSize {
+		return 0, errShortBuffer
 	}
 
-	if len(data) < MessageHandshakeInitSize {
-		return errors.New("not enough data to read handshake init message")
-	}
+	binary.LittleEndian.PutUint32(dst[0:4], m.Type)
+	binary.LittleEndian.PutUint32(dst[4:8], m.Receiver)
+	copy(dst[8:32], m.Nonce[:])
+	copy(dst[32:64], m.Cookie[:])
 
-	reader := bytes.NewReader(data)
-	if err := binary.Read(reader, binary.LittleEndian, m); err != nil {
-		return err
-	}
-	return nil
+	return MessageHandshakeCookieSize, nil
 }
-func (m *MessageHandshakeResponse) FromBytes(data []byte) error {
-	if data[0] != HandshakeResponseType {
-		return errors.New("invalid message type")
+
+func (m *MessageTransport) MarshalTo(dst []byte) (int, error) {
+	size := m.Size()
+	if len(dst) < size {
+		return 0, errShortBuffer
 	}
 
-	if len(data) != MessageHandshakeResponseSize {
-		return errors.New("not enough data to read handshake response message")
+	binary.LittleEndian.PutUint32(dst[0:4], m.Type)
+	binary.LittleEndian.PutUint32(dst[4:8], m.Receiver)
+	binary.LittleEndian.PutUint64(dst[8:16], m.Counter)
+
+	// A packet sealed in place already follows the header
+	if len(m.Packet) > 0 && &dst[MessageTransportHeaderSize] != &m.Packet[0] {
+		copy(dst[MessageTransportHeaderSize:], m.Packet)
 	}
 
-	reader := bytes.NewReader(data)
-	if err := binary.Read(reader, binary.LittleEndian, m); err != nil {
+	return size, nil
+}
+
+// Unmarshal decodes the message from src, which must have the exact size of the message and zero reserved bytes.
+func (m *MessageHandshakeInit) Unmarshal(src []byte) error {
+	if err := checkMessage(src, HandshakeInitType); err != nil {
 		return err
 	}
+
+	m.Type = binary.LittleEndian.Uint32(src[0:4])
+	m.Sender = binary.LittleEndian.Uint32(src[4:8])
+	copy(m.Ephemeral[:], src[8:40])
+	copy(m.Static[:], src[40:88])
+	copy(m.Timestamp[:], src[88:116])
+	copy(m.MAC1[:], src[116:132])
+	copy(m.MAC2[:], src[132:148])
+
 	return nil
 }
-func (m *MessageHandshakeCookie) FromBytes(data []byte) error {
-	if data[0] != HandshakeCookieType {
-		return errors.New("invalid message type")
-	}
 
-	if len(data) != MessageHandshakeCookieSize {
-		return errors.New("not enough data to read handshake cookie message")
+func (m *MessageHandshakeResponse) Unmarshal(src []byte) error {
+	if err := checkMessage(src, HandshakeResponseType); err != nil {
+		return err
 	}
 
-	reader := bytes.NewReader(data)
-	if err := binary.Read(reader, binary.LittleEndian, m); err != nil {
+	m.Type = binary.LittleEndian.Uint32(src[0:4])
+	m.Sender = binary.LittleEndian.Uint32(src[4:8])
+	m.Receiver = binary.LittleEndian.Uint32(src[8:12])
+	copy(m.Ephemeral[:], src[12:44])
+	copy(m.Empty[:], src[44:60])
+	copy(m.MAC1[:], src[60:76])
+	copy(m.MAC2[:], src[76:92])
+
+	return nil
+}
+
+func (m *MessageHandshakeCookie) Unmarshal(src []byte) error {
+	if err := checkMessage(src, HandshakeCookieType); err != nil {
 		return err
 	}
+
+	m.Type = binary.LittleEndian.Uint32(src[0:4])
+	m.Receiver = binary.LittleEndian.Uint32(src[4:8])
+	copy(m.Nonce[:], src[8:32])
+	copy(m.Cookie[:], src[32:64])
+
 	return nil
 }
-func (m *MessageTransport) FromBytes(data []byte) error {
-	if data[0] != TransportType {
-		return errors.New("invalid message type")
-	}
 
-	if len(data) < MessageTransportHeaderSize {
-		return errors.New("not enough data to read transport message")
+// Unmarshal decodes the transport header, the packet refers to the encrypted part of src.
+func (m *MessageTransport) Unmarshal(src []byte) error {
+	if err := checkMessage(src, TransportType); err != nil {
+		return err
 	}
 
-	l, r := 0, UIntSize
-	m.Type = binary.LittleEndian.Uint32(data[l:r])
+	m.Type = binary.LittleEndian.Uint32(src[0:4])
+	m.Receiver = binary.LittleEndian.Uint32(src[4:8])
+	m.Counter = binary.LittleEndian.Uint64(src[8:16])
+	m.Packet = src[MessageTransportHeaderSize:]
 
-	l, r = r, r+UIntSize
-	m.Receiver = binary.LittleEndian.Uint32(data[l:r])
+	return nil
+}
 
-	l, r = r, r+ULongSize
-	m.Counter = binary.LittleEndian.Uint64(data[l:r])
+func (m *MessageHandshakeInit) ToBytes() []byte {
+	buffer := make([]byte, m.Size())
+	m.MarshalTo(buffer)
+	return buffer
+}
 
-	l, r = r, len(data)
-	m.Packet = data[l:]
+func (m *MessageHandshakeResponse) ToBytes() []byte {
+	buffer := make([]byte, m.Size())
+	m.MarshalTo(buffer)
+	return buffer
+}
 
-	return nil
+func (m *MessageHandshakeCookie) ToBytes() []byte {
+	buffer := make([]byte, m.Size())
+	m.MarshalTo(buffer)
+	return buffer
+}
+
+func (m *MessageTransport) ToBytes() []byte {
+	buffer := make([]byte, m.Size())
+	m.MarshalTo(buffer)
+	return buffer
+}
+
+func (m *MessageHandshakeInit) FromBytes(data []byte) error {
+	return m.Unmarshal(data)
+}
+
+func (m *MessageHandshakeResponse) FromBytes(data []byte) error {
+	return m.Unmarshal(data)
+}
+
+func (m *MessageHandshakeCookie) FromBytes(data []byte) error {
+	return m.Unmarshal(data)
+}
+
+func (m *MessageTransport) FromBytes(data []byte) error {
+	return m.Unmarshal(data)
 }
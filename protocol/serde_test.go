@@ -55,7 +55,7 @@ func Test_MessageSerde_MessageTransport(t *testing.T) {
 		Type:     TransportType,
 		Receiver: math.MaxUint32,
 		Counter:  math.MaxUint64,
-		Packet:   []byte{1, 2, 3, 4},
+		Packet:   []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
 	}
 	deserialised := MessageTransport{}
 
@@ -89,3 +89,102 @@ func Test_PrivateKey_ParsingAndDerivation(t *testing.T) {
 	assert.Equal(t, pk, derivedPK)
 	assert.Equal(t, derivedEncodedPK, originalPK)
 }
+
+func Test_Keys_Base64RoundTrip(t *testing.T) {
+	sk := NewPrivateKey()
+	pk := sk.PublicKey()
+	psk := NewPresharedKey()
+
+	assert.Equal(t, sk, SkFromString(sk.ToBase64()))
+	assert.Equal(t, pk, PkFromString(pk.ToBase64()))
+
+	var decoded PresharedKey
+	assert.Nil(t, decoded.FromBase64(psk.ToBase64()))
+	assert.Equal(t, psk, decoded)
+	assert.NotEqual(t, PresharedKey{}, psk)
+
+	// Keys are 44 characters long with a single padding character, as produced by wg genkey
+	assert.Len(t, sk.ToBase64(), 44)
+	assert.Equal(t, "=", sk.ToBase64()[43:])
+
+	// Private keys are clamped on generation and when decoded
+	assert.Equal(t, byte(0), sk[0]&7)
+	assert.Equal(t, byte(64), sk[31]&192)
+}
+
+func Test_MessageSerde_MarshalToShortBuffer(t *testing.T) {
+	messages := []Message{
+		&MessageHandshakeInit{Type: HandshakeInitType},
+		&MessageHandshakeResponse{Type: HandshakeResponseType},
+		&MessageHandshakeCookie{Type: HandshakeCookieType},
+		&MessageTransport{Type: TransportType, Packet: make([]byte, 32)},
+	}
+
+	for _, message := range messages {
+		buffer := make([]byte, message.Size())
+
+		_, err := message.MarshalTo(buffer[:len(buffer)-1])
+		assert.NotNil(t, err)
+
+		n, err := message.MarshalTo(buffer)
+		assert.Nil(t, err)
+		assert.Equal(t, message.Size(), n)
+		assert.Equal(t, message.ToBytes(), buffer)
+	}
+}
+
+func Test_MessageSerde_ZeroAllocations(t *testing.T) {
+	messages := []Message{
+		&MessageHandshakeInit{Type: HandshakeInitType},
+		&MessageHandshakeResponse{Type: HandshakeResponseType},
+		&MessageHandshakeCookie{Type: HandshakeCookieType},
+		&MessageTransport{Type: TransportType, Packet: make([]byte, 1420)},
+	}
+
+	for _, message := range messages {
+		buffer := make([]byte, message.Size())
+
+		allocs := testing.AllocsPerRun(100, func() {
+			if _, err := message.MarshalTo(buffer); err != nil {
+				t.Fatal(err)
+			}
+			if err := message.Unmarshal(buffer); err != nil {
+				t.Fatal(err)
+			}
+		})
+		assert.Zero(t, allocs, "%T allocates", message)
+	}
+}
+
+func benchmarkMessageSerde(b *testing.B, message Message) {
+	buffer := make([]byte, message.Size())
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buffer)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := message.MarshalTo(buffer); err != nil {
+			b.Fatal(err)
+		}
+		if err := message.Unmarshal(buffer); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMessageSerde_MessageHandshakeInit(b *testing.B) {
+	benchmarkMessageSerde(b, &MessageHandshakeInit{Type: HandshakeInitType})
+}
+
+func BenchmarkMessageSerde_MessageHandshakeResponse(b *testing.B) {
+	benchmarkMessageSerde(b, &MessageHandshakeResponse{Type: HandshakeResponseType})
+}
+
+func BenchmarkMessageSerde_MessageHandshakeCookie(b *testing.B) {
+	benchmarkMessageSerde(b, &MessageHandshakeCookie{Type: HandshakeCookieType})
+}
+
+func BenchmarkMessageSerde_MessageTransport(b *testing.B) {
+	benchmarkMessageSerde(b, &MessageTransport{Type: TransportType, Packet: make([]byte, 1420)})
+}
@@ -0,0 +1,69 @@
+package protocol
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// TunnelStats counts the messages exchanged with a peer, it is guarded by the tunnel lock.
+// Transport messages are counted once sent or authenticated, handshake attempts are the initiations
+// created and successes the sessions derived. A rotation installs a new current keypair.
+type TunnelStats struct {
+	TxBytes            uint64
+	RxBytes            uint64
+	TxPackets          uint64
+	RxPackets          uint64
+	HandshakeAttempts  uint64
+	HandshakeSuccesses uint64
+	ReplayDrops        uint64
+	KeypairRotations   uint64
+}
+
+// CountSent counts a transport message of the size once it was written to the peer.
+func (s *TunnelStats) CountSent(size int) {
+	s.TxBytes += uint64(size)
+	s.TxPackets++
+}
+
+// HandshakeFailure is the reason a handshake message was rejected.
+type HandshakeFailure int
+
+const (
+	HandshakeFailureMAC1 HandshakeFailure = iota
+	HandshakeFailureDecryption
+	HandshakeFailureStaleTimestamp
+	HandshakeFailureOther
+	HandshakeFailureReasons
+)
+
+func (f HandshakeFailure) String() string {
+	switch f {
+	case HandshakeFailureMAC1:
+		return "bad_mac1"
+	case HandshakeFailureDecryption:
+		return "decryption"
+	case HandshakeFailureStaleTimestamp:
+		return "stale_timestamp"
+	default:
+		return "other"
+	}
+}
+
+// DeviceStats counts the events which can't be attributed to a peer,
+// as the handshake messages failing validation may come from anyone.
+type DeviceStats struct {
+	HandshakeFailures [HandshakeFailureReasons]atomic.Uint64
+	CookieRepliesSent atomic.Uint64
+}
+
+// handshakeFailed counts a rejected handshake message, classifying it by the error.
+func (s *DeviceStats) handshakeFailed(err error) {
+	reason := HandshakeFailureOther
+	switch {
+	case errors.Is(err, ErrHandshakeDecryption):
+		reason = HandshakeFailureDecryption
+	case errors.Is(err, ErrStaleTimestamp):
+		reason = HandshakeFailureStaleTimestamp
+	}
+	s.HandshakeFailures[reason].Add(1)
+}
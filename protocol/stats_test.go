@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/netip"
+	"testing"
+)
+
+func Test_TunnelStats(t *testing.T) {
+	initiator, responder := newSession(t)
+	confirmSession(t, initiator, responder)
+
+	assert.Equal(t, uint64(1), initiator.HandshakeAttempts)
+	assert.Equal(t, uint64(0), responder.HandshakeAttempts)
+	assert.Equal(t, uint64(1), initiator.HandshakeSuccesses)
+	assert.Equal(t, uint64(1), responder.HandshakeSuccesses)
+	assert.Equal(t, uint64(1), initiator.KeypairRotations)
+	assert.Equal(t, uint64(1), responder.KeypairRotations, "the confirmation rotates the responder keypairs")
+
+	message, err := initiator.CreateTransportMessage(ipv4PacketFrom(netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1"), "hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), initiator.TxPackets, "messages aren't counted as sent until they are written")
+	initiator.CountSent(len(message.ToBytes()))
+
+	_, err = responder.ProcessTransportMessage(message)
+	assert.Nil(t, err)
+	_, err = responder.ProcessTransportMessage(message)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, uint64(1), initiator.TxPackets)
+	assert.Equal(t, uint64(len(message.ToBytes())), initiator.TxBytes)
+	assert.Equal(t, uint64(2), responder.RxPackets, "replays aren't counted as received")
+	assert.Equal(t, uint64(1), responder.ReplayDrops)
+}
+
+func Test_DeviceStats_HandshakeFailures(t *testing.T) {
+	server := newIdentity()
+	client := newIdentity()
+
+	device := NewDevice(server.PrivateKey)
+	device.AddPeer(Peer{PublicKey: client.PublicKey})
+	initiator := NewDevice(client.PrivateKey).AddPeer(Peer{PublicKey: server.PublicKey})
+	stranger := NewDevice(client.PrivateKey).AddPeer(Peer{PublicKey: newIdentity().PublicKey})
+
+	_, err := device.CheckHandshakeMACs(make([]byte, MessageHandshakeInitSize), 1, netip.AddrPort{})
+	assert.NotNil(t, err)
+
+	ih, err := initiator.InitiateHandshake()
+	assert.Nil(t, err)
+	_, err = device.ProcessInitiateHandshakeMessage(ih, netip.AddrPort{})
+	assert.Nil(t, err)
+	_, err = device.ProcessInitiateHandshakeMessage(ih, netip.AddrPort{})
+	assert.ErrorIs(t, err, ErrStaleTimestamp)
+
+	// An initiation encrypted for another identity
+	ih, err = stranger.InitiateHandshake()
+	assert.Nil(t, err)
+	_, err = device.ProcessInitiateHandshakeMessage(ih, netip.AddrPort{})
+	assert.ErrorIs(t, err, ErrHandshakeDecryption)
+
+	_, err = device.ProcessInitiateHandshakeResponseMessage(MessageHandshakeResponse{Receiver: 1}, netip.AddrPort{})
+	assert.NotNil(t, err)
+
+	for reason, expected := range map[HandshakeFailure]uint64{
+		HandshakeFailureMAC1:           1,
+		HandshakeFailureDecryption:     1,
+		HandshakeFailureStaleTimestamp: 1,
+		HandshakeFailureOther:          1,
+	} {
+		assert.Equal(t, expected, device.Stats.HandshakeFailures[reason].Load(), reason.String())
+	}
+}
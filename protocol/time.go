@@ -9,6 +9,10 @@ import (
 const (
 	TimestampSIze = 12
 	Offset        = (2 << 61) + 10
+
+	// TimestampResolution is the precision of the handshake timestamps, so that
+	// they can't be used to learn the exact time an initiation was created.
+	TimestampResolution = 0x1000000 * time.Nanosecond
 )
 
 type Tai64n [TimestampSIze]byte
@@ -20,7 +24,7 @@ func (n Tai64n) After(timestamp Tai64n) bool {
 func Now(t time.Time) (ts Tai64n) {
 	now := t.Unix()
 	secs := uint64(Offset) + uint64(now)
-	nanos := uint32(t.Nanosecond()) &^ (0x1000000 - 1)
+	nanos := uint32(t.Nanosecond()) &^ uint32(TimestampResolution-1)
 
 	binary.BigEndian.PutUint64(ts[:], secs)
 	binary.BigEndian.PutUint32(ts[8:], nanos)
@@ -0,0 +1,317 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Timers implements the per-peer timer state machine from section 6 of the whitepaper.
+//
+// Events are reported by the tunnel as packets are sent and received,
+// while the actual I/O is left to the owner through OnHandshake and OnKeepalive.
+// Callbacks are invoked synchronously, possibly while the tunnel is locked,
+// so they must not call back into the tunnel directly.
+type Timers struct {
+	Clock                       Clock
+	Logger                      *slog.Logger
+	OnHandshake                 func()
+	OnKeepalive                 func()
+	OnZeroKeyMaterial           func()
+	PersistentKeepaliveInterval time.Duration
+
+	mu                   sync.Mutex
+	running              bool
+	handshakeAttempts    int
+	needAnotherKeepalive bool
+	lastHandshake        time.Time
+	lastInitiation       time.Time
+
+	retransmitHandshake peerTimer
+	sendKeepalive       peerTimer
+	newHandshake        peerTimer
+	zeroKeyMaterial     peerTimer
+	persistentKeepalive peerTimer
+}
+
+// peerTimer is a single resettable timer. Every modification starts a new
+// generation, so an expiry which raced with a reset is ignored.
+type peerTimer struct {
+	timer      Timer
+	generation uint64
+	pending    bool
+	expired    func(*Timers)
+}
+
+func (pt *peerTimer) mod(ts *Timers, d time.Duration) {
+	pt.del()
+	pt.generation++
+	pt.pending = true
+
+	generation := pt.generation
+	pt.timer = ts.Clock.AfterFunc(d, func() {
+		ts.mu.Lock()
+		if !ts.running || !pt.pending || pt.generation != generation {
+			ts.mu.Unlock()
+			return
+		}
+		pt.pending = false
+		ts.mu.Unlock()
+
+		pt.expired(ts)
+	})
+}
+
+func (pt *peerTimer) del() {
+	if pt.timer != nil {
+		pt.timer.Stop()
+		pt.timer = nil
+	}
+	pt.pending = false
+}
+
+func jitter() time.Duration {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return time.Duration(binary.LittleEndian.Uint64(b[:]) % uint64(RekeyTimeoutJitterMax))
+}
+
+func (ts *Timers) Start() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.Clock == nil {
+		ts.Clock = SystemClock{}
+	}
+	ts.retransmitHandshake.expired = (*Timers).expiredRetransmitHandshake
+	ts.sendKeepalive.expired = (*Timers).expiredSendKeepalive
+	ts.newHandshake.expired = (*Timers).expiredNewHandshake
+	ts.zeroKeyMaterial.expired = (*Timers).expiredZeroKeyMaterial
+	ts.persistentKeepalive.expired = (*Timers).expiredPersistentKeepalive
+	ts.running = true
+}
+
+func (ts *Timers) Stop() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.running = false
+	ts.retransmitHandshake.del()
+	ts.sendKeepalive.del()
+	ts.newHandshake.del()
+	ts.zeroKeyMaterial.del()
+	ts.persistentKeepalive.del()
+}
+
+func (ts *Timers) Now() time.Time {
+	if ts.Clock == nil {
+		return time.Now()
+	}
+	return ts.Clock.Now()
+}
+
+func (ts *Timers) LastHandshake() time.Time {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return ts.lastHandshake
+}
+
+func (ts *Timers) PersistentKeepalive() time.Duration {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return ts.PersistentKeepaliveInterval
+}
+
+// SetPersistentKeepalive changes the interval of running timers.
+// Enabling persistent keepalives sends a keepalive right away, so the peer learns the endpoint.
+func (ts *Timers) SetPersistentKeepalive(interval time.Duration) {
+	ts.mu.Lock()
+	enabled := ts.running && ts.PersistentKeepaliveInterval == 0 && interval > 0
+	ts.PersistentKeepaliveInterval = interval
+	if interval == 0 {
+		ts.persistentKeepalive.del()
+	}
+	ts.mu.Unlock()
+
+	if enabled {
+		ts.call(ts.OnKeepalive)
+	}
+}
+
+func (ts *Timers) HandshakeAttempts() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return ts.handshakeAttempts
+}
+
+func (ts *Timers) call(f func()) {
+	if f != nil {
+		f()
+	}
+}
+
+// RequestHandshake asks the owner for a new handshake, unless one was initiated or requested less than RekeyTimeout ago.
+func (ts *Timers) RequestHandshake() {
+	ts.mu.Lock()
+	if !ts.running || ts.Clock.Now().Sub(ts.lastInitiation) < RekeyTimeout {
+		ts.mu.Unlock()
+		return
+	}
+	// The owner initiates the handshake asynchronously, the packets sent meanwhile don't request another one
+	ts.lastInitiation = ts.Clock.Now()
+	ts.handshakeAttempts = 0
+	ts.mu.Unlock()
+
+	ts.call(ts.OnHandshake)
+}
+
+// DataSent is reported after a transport message with a non-empty payload was sent.
+func (ts *Timers) DataSent() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.running && !ts.newHandshake.pending {
+		ts.newHandshake.mod(ts, KeepaliveTimeout+RekeyTimeout+jitter())
+	}
+}
+
+// DataReceived is reported after a transport message with a non-empty payload was received.
+func (ts *Timers) DataReceived() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if !ts.running {
+		return
+	}
+
+	if !ts.sendKeepalive.pending {
+		ts.sendKeepalive.mod(ts, KeepaliveTimeout)
+	} else {
+		ts.needAnotherKeepalive = true
+	}
+}
+
+// AnyAuthenticatedPacketSent is reported after any authenticated packet, including keepalives, was sent.
+func (ts *Timers) AnyAuthenticatedPacketSent() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.running {
+		ts.sendKeepalive.del()
+	}
+}
+
+// AnyAuthenticatedPacketReceived is reported after any authenticated packet, including keepalives, was received.
+func (ts *Timers) AnyAuthenticatedPacketReceived() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.running {
+		ts.newHandshake.del()
+	}
+}
+
+// AnyAuthenticatedPacketTraversal is reported after any authenticated packet was sent or received.
+func (ts *Timers) AnyAuthenticatedPacketTraversal() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.running && ts.PersistentKeepaliveInterval > 0 {
+		ts.persistentKeepalive.mod(ts, ts.PersistentKeepaliveInterval)
+	}
+}
+
+// HandshakeInitiated is reported after a handshake initiation was sent.
+func (ts *Timers) HandshakeInitiated() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if !ts.running {
+		return
+	}
+	ts.lastInitiation = ts.Clock.Now()
+	ts.retransmitHandshake.mod(ts, RekeyTimeout+jitter())
+}
+
+// HandshakeComplete is reported once the initiator has received the response, or the responder the first data packet.
+func (ts *Timers) HandshakeComplete() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if !ts.running {
+		return
+	}
+	ts.retransmitHandshake.del()
+	ts.handshakeAttempts = 0
+	ts.lastHandshake = ts.Clock.Now()
+}
+
+// SessionDerived is reported after new transport keys were derived.
+func (ts *Timers) SessionDerived() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.running {
+		ts.zeroKeyMaterial.mod(ts, ZeroKeyMaterialTimeout)
+	}
+}
+
+func (ts *Timers) expiredRetransmitHandshake() {
+	ts.mu.Lock()
+	if ts.handshakeAttempts > MaxHandshakeAttempts {
+		// Give up, no more keepalives for a peer we can't reach,
+		// and make sure the keys are eventually zeroed.
+		ts.sendKeepalive.del()
+		if !ts.zeroKeyMaterial.pending {
+			ts.zeroKeyMaterial.mod(ts, ZeroKeyMaterialTimeout)
+		}
+		attempts := ts.handshakeAttempts
+		ts.mu.Unlock()
+
+		loggerOrDiscard(ts.Logger).Info("handshake did not complete, giving up", "attempts", attempts+1)
+		return
+	}
+	ts.handshakeAttempts++
+	attempts := ts.handshakeAttempts
+	ts.mu.Unlock()
+
+	loggerOrDiscard(ts.Logger).Debug("handshake did not complete, retrying", "attempt", attempts+1)
+
+	ts.call(ts.OnHandshake)
+}
+
+func (ts *Timers) expiredSendKeepalive() {
+	ts.call(ts.OnKeepalive)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.needAnotherKeepalive {
+		ts.needAnotherKeepalive = false
+		ts.sendKeepalive.mod(ts, KeepaliveTimeout)
+	}
+}
+
+func (ts *Timers) expiredNewHandshake() {
+	ts.mu.Lock()
+	ts.handshakeAttempts = 0
+	ts.mu.Unlock()
+
+	ts.call(ts.OnHandshake)
+}
+
+func (ts *Timers) expiredZeroKeyMaterial() {
+	loggerOrDiscard(ts.Logger).Debug("zeroing key material")
+	ts.call(ts.OnZeroKeyMaterial)
+}
+
+func (ts *Timers) expiredPersistentKeepalive() {
+	if ts.PersistentKeepalive() > 0 {
+		ts.call(ts.OnKeepalive)
+	}
+}
@@ -0,0 +1,350 @@
+package protocol
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// manualClock fires timers only when advanced explicitly
+type manualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+type manualTimer struct {
+	clock    *manualClock
+	deadline time.Time
+	f        func()
+	stopped  bool
+}
+
+func newManualClock() *manualClock {
+	return &manualClock{now: time.Unix(1_700_000_000, 0)}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *manualClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	timer := &manualTimer{clock: c, deadline: c.now.Add(d), f: f}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+func (mt *manualTimer) Stop() bool {
+	mt.clock.mu.Lock()
+	defer mt.clock.mu.Unlock()
+
+	active := !mt.stopped
+	mt.stopped = true
+	return active
+}
+
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+
+	for {
+		sort.SliceStable(c.timers, func(i, j int) bool {
+			return c.timers[i].deadline.Before(c.timers[j].deadline)
+		})
+
+		var next *manualTimer
+		for _, timer := range c.timers {
+			if !timer.stopped && !timer.deadline.After(target) {
+				next = timer
+				break
+			}
+		}
+		if next == nil {
+			break
+		}
+
+		next.stopped = true
+		c.now = next.deadline
+		c.mu.Unlock()
+		next.f()
+		c.mu.Lock()
+	}
+
+	c.now = target
+	c.mu.Unlock()
+}
+
+type timerEvents struct {
+	handshakes int
+	keepalives int
+}
+
+func newTimedSession(t *testing.T, clock Clock) (*Tunnel, *Tunnel, *timerEvents, *timerEvents) {
+	initiator, responder := newTunnels()
+
+	events := []*timerEvents{{}, {}}
+	for i, tunnel := range []*Tunnel{initiator, responder} {
+		e := events[i]
+		tunnel.Timers.Clock = clock
+		tunnel.Timers.OnHandshake = func() { e.handshakes++ }
+		tunnel.Timers.OnKeepalive = func() { e.keepalives++ }
+		tunnel.Timers.OnZeroKeyMaterial = tunnel.ZeroKeyMaterial
+		tunnel.Timers.Start()
+	}
+
+	handshake(t, initiator, responder)
+	return initiator, responder, events[0], events[1]
+}
+
+// confirmSession lets the responder start using the session derived by the handshake
+func confirmSession(t testing.TB, initiator, responder *Tunnel) {
+	message, err := initiator.CreateKeepaliveMessage()
+	assert.Nil(t, err)
+	_, err = responder.ProcessTransportMessage(message)
+	assert.Nil(t, err)
+}
+
+func Test_Timers_RetransmitHandshake(t *testing.T) {
+	clock := newManualClock()
+
+	responderSK := NewPrivateKey()
+	initiator := &Tunnel{
+		Local:  newIdentity(),
+		Remote: Peer{PublicKey: responderSK.PublicKey()},
+	}
+	initiator.Initialise()
+
+	attempts := 0
+	initiator.Timers.Clock = clock
+	initiator.Timers.OnHandshake = func() {
+		attempts++
+		_, err := initiator.InitiateHandshake()
+		assert.Nil(t, err)
+	}
+	initiator.Timers.Start()
+
+	_, err := initiator.InitiateHandshake()
+	assert.Nil(t, err)
+
+	clock.Advance(RekeyTimeout - time.Millisecond)
+	assert.Equal(t, 0, attempts, "no retransmission before REKEY_TIMEOUT")
+
+	clock.Advance(RekeyTimeoutJitterMax + time.Millisecond)
+	assert.Equal(t, 1, attempts)
+
+	clock.Advance(RekeyAttemptTime + RekeyTimeout*2 + RekeyTimeoutJitterMax*time.Duration(MaxHandshakeAttempts+2))
+	assert.Equal(t, MaxHandshakeAttempts+1, attempts, "retransmissions stop after REKEY_ATTEMPT_TIME")
+
+	clock.Advance(time.Hour)
+	assert.Equal(t, MaxHandshakeAttempts+1, attempts)
+}
+
+// Test_Timers_HandshakeAfterGivingUp checks that a client reconnects once it has data to send,
+// after the retransmissions of the previous handshake gave up.
+func Test_Timers_HandshakeAfterGivingUp(t *testing.T) {
+	clock := newManualClock()
+	initiator, _ := newTunnels()
+
+	attempts := 0
+	initiator.Timers.Clock = clock
+	initiator.Timers.OnHandshake = func() {
+		attempts++
+		_, err := initiator.InitiateHandshake()
+		assert.Nil(t, err)
+	}
+	initiator.Timers.Start()
+
+	_, err := initiator.InitiateHandshake()
+	assert.Nil(t, err)
+	clock.Advance(RekeyAttemptTime + RekeyTimeout*2 + RekeyTimeoutJitterMax*time.Duration(MaxHandshakeAttempts+2))
+	assert.Equal(t, MaxHandshakeAttempts+1, attempts, "retransmissions gave up")
+
+	_, err = initiator.CreateTransportMessage(ipv4Packet("ping"))
+	assert.Equal(t, ErrNoSession, err)
+	assert.Equal(t, MaxHandshakeAttempts+2, attempts, "data starts a new handshake")
+
+	clock.Advance(RekeyTimeout + RekeyTimeoutJitterMax)
+	assert.Equal(t, MaxHandshakeAttempts+3, attempts, "which is retransmitted again")
+}
+
+func Test_Timers_HandshakeCompleteStopsRetransmission(t *testing.T) {
+	clock := newManualClock()
+	initiator, _, initiatorEvents, _ := newTimedSession(t, clock)
+
+	clock.Advance(RekeyTimeout + RekeyTimeoutJitterMax)
+	assert.Equal(t, 0, initiatorEvents.handshakes)
+	assert.Equal(t, clock.Now().Add(-RekeyTimeout-RekeyTimeoutJitterMax), initiator.Timers.LastHandshake())
+}
+
+func Test_Timers_PassiveKeepalive(t *testing.T) {
+	clock := newManualClock()
+	initiator, responder, initiatorEvents, responderEvents := newTimedSession(t, clock)
+
+	message, err := initiator.CreateTransportMessage(ipv4Packet("ping"))
+	assert.Nil(t, err)
+	_, err = responder.ProcessTransportMessage(message)
+	assert.Nil(t, err)
+
+	clock.Advance(KeepaliveTimeout - time.Millisecond)
+	assert.Equal(t, 0, responderEvents.keepalives)
+
+	clock.Advance(time.Millisecond)
+	assert.Equal(t, 1, responderEvents.keepalives, "keepalive after KEEPALIVE_TIMEOUT of silence")
+	assert.Equal(t, 0, initiatorEvents.keepalives)
+
+	// Replying with data cancels the keepalive
+	message, err = initiator.CreateTransportMessage(ipv4Packet("ping"))
+	assert.Nil(t, err)
+	_, err = responder.ProcessTransportMessage(message)
+	assert.Nil(t, err)
+
+	reply, err := responder.CreateTransportMessage(ipv4Packet("pong"))
+	assert.Nil(t, err)
+	_, err = initiator.ProcessTransportMessage(reply)
+	assert.Nil(t, err)
+
+	clock.Advance(KeepaliveTimeout)
+	assert.Equal(t, 1, responderEvents.keepalives)
+}
+
+func Test_Timers_NewHandshakeWithoutReply(t *testing.T) {
+	clock := newManualClock()
+	initiator, _, initiatorEvents, _ := newTimedSession(t, clock)
+
+	_, err := initiator.CreateTransportMessage(ipv4Packet("ping"))
+	assert.Nil(t, err)
+
+	clock.Advance(KeepaliveTimeout + RekeyTimeout - time.Millisecond)
+	assert.Equal(t, 0, initiatorEvents.handshakes)
+
+	clock.Advance(RekeyTimeoutJitterMax + time.Millisecond)
+	assert.Equal(t, 1, initiatorEvents.handshakes, "new handshake after KEEPALIVE_TIMEOUT + REKEY_TIMEOUT without reply")
+}
+
+func Test_Timers_RekeyAfterTime(t *testing.T) {
+	clock := newManualClock()
+	initiator, responder, initiatorEvents, responderEvents := newTimedSession(t, clock)
+
+	confirmSession(t, initiator, responder)
+	clock.Advance(RekeyAfterTime)
+
+	_, err := initiator.CreateKeepaliveMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, initiatorEvents.handshakes, "initiator rekeys after REKEY_AFTER_TIME")
+
+	_, err = responder.CreateKeepaliveMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, responderEvents.handshakes, "responder doesn't rekey on time")
+}
+
+func Test_Timers_RekeyOnReceiveBeforeExpiry(t *testing.T) {
+	clock := newManualClock()
+	initiator, responder, initiatorEvents, _ := newTimedSession(t, clock)
+
+	confirmSession(t, initiator, responder)
+	clock.Advance(RejectAfterTime - KeepaliveTimeout - RekeyTimeout)
+
+	message, err := responder.CreateKeepaliveMessage()
+	assert.Nil(t, err)
+	_, err = initiator.ProcessTransportMessage(message)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, initiatorEvents.handshakes)
+}
+
+func Test_Timers_RejectAfterTime(t *testing.T) {
+	clock := newManualClock()
+	initiator, responder, _, _ := newTimedSession(t, clock)
+
+	message, err := initiator.CreateKeepaliveMessage()
+	assert.Nil(t, err)
+
+	clock.Advance(RejectAfterTime)
+
+	_, err = initiator.CreateKeepaliveMessage()
+	assert.NotNil(t, err, "sending is rejected after REJECT_AFTER_TIME")
+
+	_, err = responder.ProcessTransportMessage(message)
+	assert.NotNil(t, err, "receiving is rejected after REJECT_AFTER_TIME")
+}
+
+func Test_Timers_HandshakeOnSendWithoutSession(t *testing.T) {
+	clock := newManualClock()
+	initiator, _ := newTunnels()
+
+	handshakes := 0
+	initiator.Timers.Clock = clock
+	initiator.Timers.OnHandshake = func() { handshakes++ }
+	initiator.Timers.Start()
+
+	_, err := initiator.CreateTransportMessage(ipv4Packet("ping"))
+	assert.Equal(t, ErrNoSession, err)
+	assert.Equal(t, 1, handshakes, "data without a session requests a handshake")
+
+	_, err = initiator.CreateTransportMessage(ipv4Packet("ping"))
+	assert.Equal(t, ErrNoSession, err)
+	assert.Equal(t, 1, handshakes, "no other handshake within REKEY_TIMEOUT")
+}
+
+func Test_Timers_HandshakeOnSendWithExpiredSession(t *testing.T) {
+	clock := newManualClock()
+	initiator, responder, initiatorEvents, responderEvents := newTimedSession(t, clock)
+
+	confirmSession(t, initiator, responder)
+	clock.Advance(RejectAfterTime)
+	assert.Equal(t, 0, initiatorEvents.handshakes)
+
+	_, err := initiator.CreateTransportMessage(ipv4Packet("ping"))
+	assert.Equal(t, ErrNoSession, err)
+	assert.Equal(t, 1, initiatorEvents.handshakes, "data with an expired session requests a handshake")
+
+	_, err = responder.CreateTransportMessage(ipv4Packet("pong"))
+	assert.Equal(t, ErrNoSession, err)
+	assert.Equal(t, 1, responderEvents.handshakes, "the responder requests one as well")
+}
+
+func Test_Timers_ZeroKeyMaterial(t *testing.T) {
+	clock := newManualClock()
+	initiator, responder, _, _ := newTimedSession(t, clock)
+
+	clock.Advance(ZeroKeyMaterialTimeout - time.Second)
+	assert.NotNil(t, initiator.Keypairs.Current)
+	assert.NotNil(t, responder.Keypairs.Next)
+
+	clock.Advance(time.Second)
+	assert.Equal(t, Keypairs{}, initiator.Keypairs, "keys are zeroed after 3 * REJECT_AFTER_TIME")
+	assert.Equal(t, Keypairs{}, responder.Keypairs, "keys are zeroed after 3 * REJECT_AFTER_TIME")
+	assert.Equal(t, Created, initiator.Handshake.Status)
+}
+
+func Test_Timers_PersistentKeepalive(t *testing.T) {
+	clock := newManualClock()
+	initiator, _, initiatorEvents, _ := newTimedSession(t, clock)
+	initiator.Timers.PersistentKeepaliveInterval = 25 * time.Second
+
+	_, err := initiator.CreateKeepaliveMessage()
+	assert.Nil(t, err)
+
+	clock.Advance(25 * time.Second)
+	assert.Equal(t, 1, initiatorEvents.keepalives)
+}
+
+func Test_Timers_Stop(t *testing.T) {
+	clock := newManualClock()
+	initiator, _, initiatorEvents, _ := newTimedSession(t, clock)
+
+	_, err := initiator.CreateTransportMessage(ipv4Packet("ping"))
+	assert.Nil(t, err)
+
+	initiator.Timers.Stop()
+	clock.Advance(time.Hour)
+	assert.Equal(t, 0, initiatorEvents.handshakes)
+	assert.NotNil(t, initiator.Keypairs.Current)
+}
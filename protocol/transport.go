@@ -0,0 +1,287 @@
+package protocol
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"net/netip"
+)
+
+const (
+	IPv4HeaderSize = 20
+	IPv6HeaderSize = 40
+)
+
+// ErrNoSession is returned for an outbound packet while the peer has no usable session.
+// A handshake is requested, so the packet may be sent once the session is established.
+var ErrNoSession = errors.New("no active session")
+
+func transportNonce(nonce *[chacha20poly1305.NonceSize]byte, counter uint64) {
+	// 5.4.6 of the whitepaper:
+	// 32 bits of zeros followed by the 64-bit little-endian value of the counter
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+}
+
+func paddedLength(size int) int {
+	return (size + PaddingMultiple - 1) &^ (PaddingMultiple - 1)
+}
+
+// transportJob carries a transport message through the stages of its processing.
+// Only the preparing and completing stages need the tunnel lock, the AEAD
+// captured by the preparing stage may be used concurrently in between.
+type transportJob struct {
+	tunnel  *Tunnel
+	keypair *Keypair
+	aead    cipher.AEAD
+	message MessageTransport
+	packet  []byte
+	src     netip.AddrPort
+	buffer  *MessageBuffer
+	inbound bool
+	err     error
+	ready   chan struct{}
+}
+
+// CreateTransportMessage encrypts an inner IP packet with the current keypair.
+// An empty packet produces a keepalive message.
+func (t *Tunnel) CreateTransportMessage(packet []byte) (MessageTransport, error) {
+	buffer := make([]byte, paddedLength(len(packet))+chacha20poly1305.Overhead)
+	copy(buffer, packet)
+
+	job, err := t.prepareSend(buffer, len(packet))
+	if err != nil {
+		return MessageTransport{}, err
+	}
+
+	job.seal()
+	return job.message, nil
+}
+
+// prepareSend reserves a counter of the current keypair for the inner packet held in buffer[:size].
+// The buffer must have room for the padding and the authentication tag, it is encrypted in place by seal.
+func (t *Tunnel) prepareSend(buffer []byte, size int) (*transportJob, error) {
+	// 6.2 of the whitepaper: a packet without a session, or with an expired one, starts a handshake
+	keypair := t.Keypairs.Current
+	if keypair == nil || keypair.SendKey == nil {
+		t.Timers.RequestHandshake()
+		return nil, ErrNoSession
+	}
+
+	if keypair.SendNonce >= RejectAfterMessages {
+		return nil, errors.New("nonce limit reached")
+	}
+
+	age := t.Timers.Now().Sub(keypair.Created)
+	if age >= RejectAfterTime {
+		t.Timers.RequestHandshake()
+		return nil, ErrNoSession
+	}
+
+	padded := paddedLength(size)
+	if padded+chacha20poly1305.Overhead > len(buffer) {
+		return nil, errors.New("no room for the padding of the packet")
+	}
+
+	counter := keypair.SendNonce
+	keypair.SendNonce++
+
+	// 5.4.6 of the whitepaper:
+	// P := P || 0^(16 * ceil(||P|| / 16) - ||P||)
+	plaintext := buffer[:padded]
+	clear(plaintext[size:])
+
+	job := &transportJob{
+		tunnel:  t,
+		keypair: keypair,
+		aead:    keypair.SendKey,
+		message: MessageTransport{
+			Type:     TransportType,
+			Receiver: keypair.RemoteID,
+			Counter:  counter,
+		},
+		packet: plaintext,
+	}
+	if size > 0 {
+		t.Timers.DataSent()
+	}
+	t.Timers.AnyAuthenticatedPacketSent()
+	t.Timers.AnyAuthenticatedPacketTraversal()
+
+	// 6.2 of the whitepaper: the initiator rekeys an old session,
+	// either party rekeys after too many messages
+	if counter >= RekeyAfterMessages || (keypair.IsInitiator && age >= RekeyAfterTime) {
+		t.Timers.RequestHandshake()
+	}
+
+	return job, nil
+}
+
+func (job *transportJob) seal() {
+	var nonce [chacha20poly1305.NonceSize]byte
+	transportNonce(&nonce, job.message.Counter)
+
+	job.message.Packet = job.aead.Seal(job.packet[:0], nonce[:], job.packet, nil)
+}
+
+// CreateKeepaliveMessage produces a transport message with an empty payload.
+func (t *Tunnel) CreateKeepaliveMessage() (MessageTransport, error) {
+	return t.CreateTransportMessage(nil)
+}
+
+// ProcessTransportMessage authenticates and decrypts an incoming transport message
+// with whichever keypair it is addressed to.
+// The returned packet has padding stripped; an empty packet indicates a keepalive.
+func (t *Tunnel) ProcessTransportMessage(message MessageTransport) ([]byte, error) {
+	job, err := t.prepareReceive(message)
+	if err != nil {
+		return nil, err
+	}
+
+	job.open()
+	return t.completeReceive(job)
+}
+
+// prepareReceive finds the keypair the message is addressed to.
+// The message is decrypted by open into the packet buffer of the job,
+// which is allocated unless the caller provides one.
+func (t *Tunnel) prepareReceive(message MessageTransport) (*transportJob, error) {
+	keypair := t.lookupKeypair(message.Receiver)
+	if keypair == nil || keypair.ReceiveKey == nil {
+		return nil, errors.New("no active session")
+	}
+
+	if message.Counter >= RejectAfterMessages {
+		return nil, errors.New("counter is out of range")
+	}
+
+	if t.Timers.Now().Sub(keypair.Created) >= RejectAfterTime {
+		return nil, errors.New("session has expired")
+	}
+
+	return &transportJob{
+		tunnel:  t,
+		keypair: keypair,
+		aead:    keypair.ReceiveKey,
+		message: message,
+		inbound: true,
+	}, nil
+}
+
+func (job *transportJob) open() {
+	var nonce [chacha20poly1305.NonceSize]byte
+	transportNonce(&nonce, job.message.Counter)
+
+	job.packet, job.err = job.aead.Open(job.packet, nonce[:], job.message.Packet, nil)
+	if job.err != nil {
+		job.err = errors.New("failed to decrypt the transport message")
+	}
+}
+
+// completeReceive validates the counter of a decrypted message and updates the session state.
+// Messages must be completed in the order they were received for the timers to be accurate.
+func (t *Tunnel) completeReceive(job *transportJob) ([]byte, error) {
+	if job.err != nil {
+		return nil, job.err
+	}
+
+	// The keypair may have been dropped while the message was decrypted
+	keypair := job.keypair
+	if t.lookupKeypair(job.message.Receiver) != keypair {
+		return nil, errors.New("no active session")
+	}
+
+	// Only authenticated counters may advance the window
+	if !keypair.Replay.ValidateCounter(job.message.Counter, RejectAfterMessages) {
+		t.ReplayDrops++
+		return nil, errors.New("replayed or outdated counter")
+	}
+
+	t.RxBytes += uint64(MessageTransportHeaderSize + len(job.message.Packet))
+	t.RxPackets++
+
+	if t.confirmKeypair(keypair) {
+		t.Timers.HandshakeComplete()
+	}
+
+	t.Timers.AnyAuthenticatedPacketReceived()
+	t.Timers.AnyAuthenticatedPacketTraversal()
+
+	// 6.2 of the whitepaper: the initiator rekeys a session which is about to expire,
+	// so it doesn't have to wait for the responder to send something
+	age := t.Timers.Now().Sub(keypair.Created)
+	if keypair.IsInitiator && age >= RejectAfterTime-KeepaliveTimeout-RekeyTimeout {
+		t.Timers.RequestHandshake()
+	}
+
+	packet := job.packet
+	if len(packet) == 0 {
+		return packet, nil
+	}
+	t.Timers.DataReceived()
+
+	size, err := packetLength(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	return packet[:size], nil
+}
+
+// packetLength reads the length of an inner packet from its IP header,
+// as padding added by the sender is not part of the packet itself.
+func packetLength(packet []byte) (int, error) {
+	var size int
+
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < IPv4HeaderSize {
+			return 0, errors.New("inner packet is too short")
+		}
+		size = int(binary.BigEndian.Uint16(packet[2:4]))
+	case 6:
+		if len(packet) < IPv6HeaderSize {
+			return 0, errors.New("inner packet is too short")
+		}
+		size = IPv6HeaderSize + int(binary.BigEndian.Uint16(packet[4:6]))
+	default:
+		return 0, errors.New("unknown inner packet version")
+	}
+
+	if size > len(packet) {
+		return 0, errors.New("inner packet length exceeds the payload")
+	}
+
+	return size, nil
+}
+
+// PacketSource reads the source address from the IP header of an inner packet.
+func PacketSource(packet []byte) (netip.Addr, error) {
+	return packetAddress(packet, 12, 8)
+}
+
+// PacketDestination reads the destination address from the IP header of an inner packet.
+func PacketDestination(packet []byte) (netip.Addr, error) {
+	return packetAddress(packet, 16, 24)
+}
+
+func packetAddress(packet []byte, offsetIPv4, offsetIPv6 int) (netip.Addr, error) {
+	if len(packet) == 0 {
+		return netip.Addr{}, errors.New("empty inner packet")
+	}
+
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < IPv4HeaderSize {
+			return netip.Addr{}, errors.New("inner packet is too short")
+		}
+		return netip.AddrFrom4([4]byte(packet[offsetIPv4 : offsetIPv4+4])), nil
+	case 6:
+		if len(packet) < IPv6HeaderSize {
+			return netip.Addr{}, errors.New("inner packet is too short")
+		}
+		return netip.AddrFrom16([16]byte(packet[offsetIPv6 : offsetIPv6+16])), nil
+	default:
+		return netip.Addr{}, errors.New("unknown inner packet version")
+	}
+}
@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"net/netip"
+	"testing"
+)
+
+// newTunnels creates two tunnels which are each other's peer.
+// The tests of the package can't import vpntest, as it imports the package.
+func newTunnels() (*Tunnel, *Tunnel) {
+	initiatorSK := NewPrivateKey()
+	responderSK := NewPrivateKey()
+
+	initiator := &Tunnel{
+		Local:  NewIdentity(initiatorSK),
+		Remote: Peer{PublicKey: responderSK.PublicKey()},
+	}
+	responder := &Tunnel{
+		Local:  NewIdentity(responderSK),
+		Remote: Peer{PublicKey: initiatorSK.PublicKey()},
+	}
+	initiator.Initialise()
+	responder.Initialise()
+	return initiator, responder
+}
+
+func newSession(t *testing.T) (*Tunnel, *Tunnel) {
+	initiator, responder := newTunnels()
+	handshake(t, initiator, responder)
+	return initiator, responder
+}
+
+func ipv4Packet(payload string) []byte {
+	packet := make([]byte, IPv4HeaderSize+len(payload))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	copy(packet[IPv4HeaderSize:], payload)
+	return packet
+}
+
+func ipv4PacketFrom(src, dst netip.Addr, payload string) []byte {
+	packet := ipv4Packet(payload)
+	copy(packet[12:16], src.AsSlice())
+	copy(packet[16:20], dst.AsSlice())
+	return packet
+}
+
+func ipv6PacketFrom(src, dst netip.Addr, payload string) []byte {
+	packet := make([]byte, IPv6HeaderSize+len(payload))
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(payload)))
+	copy(packet[8:24], src.AsSlice())
+	copy(packet[24:40], dst.AsSlice())
+	copy(packet[IPv6HeaderSize:], payload)
+	return packet
+}
+
+func Test_TransportMessage_RoundTrip(t *testing.T) {
+	initiator, responder := newSession(t)
+
+	packet := ipv4Packet("hello world")
+
+	message, err := initiator.CreateTransportMessage(packet)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), message.Counter)
+	assert.Equal(t, responder.LocalID, message.Receiver)
+	assert.Zero(t, len(message.Packet)%PaddingMultiple)
+
+	var received MessageTransport
+	assert.Nil(t, received.FromBytes(message.ToBytes()))
+
+	decrypted, err := responder.ProcessTransportMessage(received)
+	assert.Nil(t, err)
+	assert.Equal(t, packet, decrypted)
+
+	reply, err := responder.CreateTransportMessage(packet)
+	assert.Nil(t, err)
+
+	decrypted, err = initiator.ProcessTransportMessage(reply)
+	assert.Nil(t, err)
+	assert.Equal(t, packet, decrypted)
+}
+
+func Test_TransportMessage_Keepalive(t *testing.T) {
+	initiator, responder := newSession(t)
+
+	message, err := initiator.CreateKeepaliveMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, MessageTransportHeaderSize+16, len(message.ToBytes()))
+
+	decrypted, err := responder.ProcessTransportMessage(message)
+	assert.Nil(t, err)
+	assert.Empty(t, decrypted)
+}
+
+func Test_TransportMessage_CounterIncrements(t *testing.T) {
+	initiator, _ := newSession(t)
+
+	for i := uint64(0); i < 3; i++ {
+		message, err := initiator.CreateKeepaliveMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, i, message.Counter)
+	}
+}
+
+func Test_TransportMessage_TamperedMessageRejected(t *testing.T) {
+	initiator, responder := newSession(t)
+
+	message, err := initiator.CreateTransportMessage(ipv4Packet("hello world"))
+	assert.Nil(t, err)
+
+	message.Packet[0] ^= 0xff
+	_, err = responder.ProcessTransportMessage(message)
+	assert.NotNil(t, err)
+}
+
+func Test_TransportMessage_NoSession(t *testing.T) {
+	tunnel := Tunnel{}
+
+	_, err := tunnel.CreateTransportMessage(ipv4Packet("hello world"))
+	assert.NotNil(t, err)
+
+	_, err = tunnel.ProcessTransportMessage(MessageTransport{Type: TransportType})
+	assert.NotNil(t, err)
+}
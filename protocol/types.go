@@ -13,6 +13,7 @@ const (
 	PublicKeySize       = 32
 	PrivateKeySize      = 32
 	SharedSecretSize    = 32
+	PresharedKeySize    = 32
 	Tai64nTimestampSIze = 12
 	CookieNonceSize     = 24
 	CookieSize          = 16
@@ -23,6 +24,7 @@ type (
 	SharedSecret [SharedSecretSize]byte
 	PrivateKey   [PrivateKeySize]byte
 	CookieNonce  [CookieNonceSize]byte
+	PresharedKey [PresharedKeySize]byte
 )
 
 const (
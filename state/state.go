@@ -0,0 +1,201 @@
+// Package state keeps the handshake timestamps of the peers on disk,
+// so that a restarted device still rejects initiations replayed from before the restart.
+package state
+
+import (
+	"bufio"
+	"com.github.grambbledook/simple_vpn/protocol"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// File is a protocol.TimestampStore backed by a text file with a line per peer:
+// the base64 public key followed by the hex encoded TAI64N timestamp.
+//
+// Store only updates the timestamps in memory, the file is replaced atomically
+// by a background writer, so the updates made while it writes are batched.
+// OnError reports the failed writes, it must be set before the first Store.
+// Close writes the latest timestamps and stops the writer.
+type File struct {
+	OnError func(error)
+
+	path string
+
+	mu         sync.Mutex
+	timestamps map[protocol.PublicKey]protocol.Tai64n
+	version    uint64
+	closed     bool
+
+	// writeMu orders the writes, so an older snapshot never replaces a newer one
+	writeMu sync.Mutex
+	written uint64
+
+	dirty chan struct{}
+	done  chan struct{}
+}
+
+// Open loads the state file at path, a missing file is treated as an empty state.
+func Open(path string) (*File, error) {
+	f := &File{
+		path:       path,
+		timestamps: make(map[protocol.PublicKey]protocol.Tai64n),
+		dirty:      make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+
+	go f.run()
+	return f, nil
+}
+
+func (f *File) load() error {
+	file, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected a public key and a timestamp", f.path, line)
+		}
+
+		var pk protocol.PublicKey
+		if err := pk.FromBase64(fields[0]); err != nil {
+			return fmt.Errorf("%s:%d: %w", f.path, line, err)
+		}
+
+		var ts protocol.Tai64n
+		raw, err := hex.DecodeString(fields[1])
+		if err != nil || len(raw) != len(ts) {
+			return fmt.Errorf("%s:%d: invalid timestamp", f.path, line)
+		}
+		copy(ts[:], raw)
+
+		f.timestamps[pk] = ts
+	}
+	return scanner.Err()
+}
+
+func (f *File) Load(pk protocol.PublicKey) (protocol.Tai64n, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ts, ok := f.timestamps[pk]
+	return ts, ok
+}
+
+// Store records the timestamp and schedules a write of the whole state.
+// It fails only once the file is closed.
+func (f *File) Store(pk protocol.PublicKey, ts protocol.Tai64n) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+
+	f.timestamps[pk] = ts
+	f.version++
+
+	select {
+	case f.dirty <- struct{}{}:
+	default:
+		// A write is already scheduled and will pick up this timestamp
+	}
+	return nil
+}
+
+func (f *File) run() {
+	defer close(f.done)
+
+	for range f.dirty {
+		if err := f.Flush(); err != nil && f.OnError != nil {
+			f.OnError(err)
+		}
+	}
+}
+
+// Flush writes the timestamps stored since the last successful write.
+func (f *File) Flush() error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	f.mu.Lock()
+	version := f.version
+	if version == f.written {
+		f.mu.Unlock()
+		return nil
+	}
+	lines := make([]string, 0, len(f.timestamps))
+	for pk, ts := range f.timestamps {
+		lines = append(lines, pk.ToBase64()+" "+hex.EncodeToString(ts[:]))
+	}
+	f.mu.Unlock()
+
+	if err := f.write(lines); err != nil {
+		return err
+	}
+	f.written = version
+	return nil
+}
+
+// Close stops the background writer and writes the timestamps it hasn't written yet.
+func (f *File) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.closed = true
+	close(f.dirty)
+	f.mu.Unlock()
+
+	<-f.done
+	return f.Flush()
+}
+
+// write replaces the state file with a temporary one, so that a crash never leaves a partial state.
+func (f *File) write(lines []string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for _, line := range lines {
+		w.WriteString(line + "\n")
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
@@ -0,0 +1,117 @@
+package state
+
+import (
+	"com.github.grambbledook/simple_vpn/protocol"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_File_StoreAndReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wg0.state")
+	pk := protocol.NewIdentity(protocol.NewPrivateKey()).PublicKey
+	ts := protocol.Now(time.Now())
+
+	f, err := Open(path)
+	assert.Nil(t, err)
+	_, ok := f.Load(pk)
+	assert.False(t, ok, "a missing file is an empty state")
+
+	assert.Nil(t, f.Store(pk, ts))
+	assert.Nil(t, f.Close())
+	assert.ErrorIs(t, f.Store(pk, ts), os.ErrClosed)
+
+	reopened, err := Open(path)
+	assert.Nil(t, err)
+	loaded, ok := reopened.Load(pk)
+	assert.True(t, ok)
+	assert.Equal(t, ts, loaded)
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1, "temporary files are removed")
+}
+
+func Test_File_WritesInBackground(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wg0.state")
+	pk := protocol.NewIdentity(protocol.NewPrivateKey()).PublicKey
+
+	f, err := Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, f.Store(pk, protocol.Now(time.Now().Add(time.Duration(i)*time.Second))))
+	}
+	last := protocol.Now(time.Now().Add(time.Hour))
+	assert.Nil(t, f.Store(pk, last))
+
+	assert.Eventually(t, func() bool {
+		reopened, err := Open(path)
+		if err != nil {
+			return false
+		}
+		defer reopened.Close()
+		loaded, _ := reopened.Load(pk)
+		return loaded == last
+	}, time.Second, 10*time.Millisecond)
+}
+
+func Test_File_WriteFailure(t *testing.T) {
+	dir := t.TempDir()
+	pk := protocol.NewIdentity(protocol.NewPrivateKey()).PublicKey
+	ts := protocol.Now(time.Now())
+
+	f, err := Open(filepath.Join(dir, "state", "wg0.state"))
+	assert.Nil(t, err)
+	failures := make(chan error, 1)
+	f.OnError = func(err error) { failures <- err }
+
+	assert.Nil(t, f.Store(pk, ts), "the file is written in background")
+	select {
+	case err := <-failures:
+		assert.NotNil(t, err, "the directory doesn't exist")
+	case <-time.After(time.Second):
+		t.Fatal("the failed write isn't reported")
+	}
+	loaded, _ := f.Load(pk)
+	assert.Equal(t, ts, loaded, "the timestamp is kept in memory")
+
+	// The timestamp is written once the directory exists
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "state"), 0700))
+	assert.Nil(t, f.Close())
+
+	reopened, err := Open(filepath.Join(dir, "state", "wg0.state"))
+	assert.Nil(t, err)
+	defer reopened.Close()
+	loaded, _ = reopened.Load(pk)
+	assert.Equal(t, ts, loaded)
+}
+
+func Test_File_InvalidContent(t *testing.T) {
+	pk := protocol.NewIdentity(protocol.NewPrivateKey()).PublicKey.ToBase64()
+
+	tests := map[string]string{
+		"missing timestamp": pk + "\n",
+		"invalid key":       "key 000000000000000000000000\n",
+		"short timestamp":   pk + " 0000\n",
+		"long timestamp":    pk + " 00000000000000000000000000\n",
+		"not hex":           pk + " zz0000000000000000000000\n",
+	}
+
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "wg0.state")
+			assert.Nil(t, os.WriteFile(path, []byte(content), 0600))
+
+			_, err := Open(path)
+			assert.NotNil(t, err)
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package tun
+
+import (
+	"com.github.grambbledook/simple_vpn/protocol"
+	"errors"
+	"io"
+	"net/netip"
+	"os"
+)
+
+// Forwarder moves inner packets between a device and a pipeline:
+// the packets read from the device are encrypted by the pipeline,
+// and the packets it decrypts are written back into the device by Receive,
+// which is meant to be the OnReceive of the pipeline.
+//
+// OnDrop is called for the packets which can't be routed, encrypted or written.
+type Forwarder struct {
+	Device   Device
+	Pipeline *protocol.Pipeline
+	OnDrop   func(err error)
+}
+
+// Run reads packets from the device until it fails, returning nil once the device is closed.
+func (f *Forwarder) Run() error {
+	for {
+		// The packet is read behind the headroom of the transport header, so it is encrypted in place
+		buffer := f.Pipeline.Buffers.Get()
+		n, err := f.Device.Read(buffer[protocol.MessageTransportOffsetContent:])
+		if err != nil {
+			f.Pipeline.Buffers.Put(buffer)
+			if errors.Is(err, io.EOF) || errors.Is(err, os.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		if n == 0 {
+			f.Pipeline.Buffers.Put(buffer)
+			continue
+		}
+
+		if err := f.Pipeline.EncryptBuffer(buffer, n); err != nil {
+			f.drop(err)
+		}
+	}
+}
+
+// Receive writes a packet decrypted by the pipeline into the device, keepalives have nothing to write.
+func (f *Forwarder) Receive(_ *protocol.Tunnel, packet []byte, _ netip.AddrPort) {
+	if len(packet) == 0 {
+		return
+	}
+
+	if _, err := f.Device.Write(packet); err != nil {
+		f.drop(err)
+	}
+}
+
+func (f *Forwarder) drop(err error) {
+	if f.OnDrop != nil {
+		f.OnDrop(err)
+	}
+}
@@ -0,0 +1,38 @@
+package tun_test
+
+import (
+	"com.github.grambbledook/simple_vpn/internal/vpntest"
+	"com.github.grambbledook/simple_vpn/protocol"
+	"com.github.grambbledook/simple_vpn/tun"
+	"github.com/stretchr/testify/assert"
+	"net/netip"
+	"testing"
+)
+
+func Test_Forwarder_Drops(t *testing.T) {
+	aliceAddr, bobAddr := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	alice, _ := vpntest.NewPeers(netip.PrefixFrom(aliceAddr, 32), netip.PrefixFrom(bobAddr, 32))
+
+	device, stack := tun.NewPipe("alice", 1420)
+	pipeline := &protocol.Pipeline{Device: alice}
+	pipeline.Start()
+	defer pipeline.Stop()
+
+	drops := make(chan error, 3)
+	forwarder := &tun.Forwarder{Device: device, Pipeline: pipeline, OnDrop: func(err error) { drops <- err }}
+	done := make(chan error)
+	go func() { done <- forwarder.Run() }()
+
+	_, err := stack.Write(vpntest.IPv4Packet(aliceAddr, netip.MustParseAddr("10.0.0.9"), "no route"))
+	assert.Nil(t, err)
+	assert.NotNil(t, <-drops)
+
+	forwarder.Receive(nil, nil, netip.AddrPort{})
+	assert.Empty(t, drops, "keepalives aren't written")
+
+	assert.Nil(t, device.Close())
+	assert.Nil(t, <-done, "the forwarder stops once the device is closed")
+
+	forwarder.Receive(nil, vpntest.IPv4Packet(bobAddr, aliceAddr, "closed"), netip.AddrPort{})
+	assert.NotNil(t, <-drops, "packets can't be written into a closed device")
+}
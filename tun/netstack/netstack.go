@@ -0,0 +1,372 @@
+// Package netstack terminates the tunnel in a userspace TCP/IP stack,
+// so that programs could talk through it without creating a kernel TUN device.
+package netstack
+
+import (
+	"com.github.grambbledook/simple_vpn/tun"
+	"context"
+	"errors"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	nicID     = 1
+	queueSize = 1024
+	dnsPort   = 53
+)
+
+// device is the tun.Device side of the stack: packets sent by the stack are read from it,
+// and packets written into it are delivered to the stack.
+type device struct {
+	endpoint *channel.Endpoint
+	stack    *stack.Stack
+	notify   *channel.NotificationHandle
+	events   chan tun.Event
+	incoming chan *buffer.View
+	mtu      int
+
+	// closed stops the readers and the stack notifications, incoming is never closed
+	// as the stack may still be sending into it
+	closed chan struct{}
+	once   sync.Once
+}
+
+// Net exposes the dialers and listeners of the userspace stack.
+type Net struct {
+	stack      *stack.Stack
+	dnsServers []netip.Addr
+	hasV4      bool
+	hasV6      bool
+}
+
+// CreateNetTUN creates a userspace stack owning the local addresses.
+// The device should be given to the tunnel, while the Net is used to open connections through it.
+func CreateNetTUN(localAddresses, dnsServers []netip.Addr, mtu int) (tun.Device, *Net, error) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
+		HandleLocal:        true,
+	})
+
+	dev := &device{
+		endpoint: channel.New(queueSize, uint32(mtu), ""),
+		stack:    s,
+		events:   make(chan tun.Event, 2),
+		incoming: make(chan *buffer.View, queueSize),
+		mtu:      mtu,
+		closed:   make(chan struct{}),
+	}
+	n := &Net{stack: s, dnsServers: dnsServers}
+
+	sack := tcpip.TCPSACKEnabled(true)
+	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &sack); err != nil {
+		return nil, nil, fmt.Errorf("could not enable TCP SACK: %v", err)
+	}
+
+	dev.notify = dev.endpoint.AddNotify(dev)
+	if err := s.CreateNIC(nicID, dev.endpoint); err != nil {
+		return nil, nil, fmt.Errorf("could not create NIC: %v", err)
+	}
+
+	for _, addr := range localAddresses {
+		var protocol tcpip.NetworkProtocolNumber
+		if addr.Is4() {
+			protocol = ipv4.ProtocolNumber
+			n.hasV4 = true
+		} else {
+			protocol = ipv6.ProtocolNumber
+			n.hasV6 = true
+		}
+
+		address := tcpip.ProtocolAddress{
+			Protocol:          protocol,
+			AddressWithPrefix: tcpip.AddrFromSlice(addr.AsSlice()).WithPrefix(),
+		}
+		if err := s.AddProtocolAddress(nicID, address, stack.AddressProperties{}); err != nil {
+			return nil, nil, fmt.Errorf("could not add address %v: %v", addr, err)
+		}
+	}
+
+	if n.hasV4 {
+		s.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: nicID})
+	}
+	if n.hasV6 {
+		s.AddRoute(tcpip.Route{Destination: header.IPv6EmptySubnet, NIC: nicID})
+	}
+
+	dev.events <- tun.EventUp
+	return dev, n, nil
+}
+
+func (dev *device) Read(packet []byte) (int, error) {
+	select {
+	case <-dev.closed:
+		return 0, os.ErrClosed
+	default:
+	}
+
+	var view *buffer.View
+	select {
+	case view = <-dev.incoming:
+	case <-dev.closed:
+		return 0, os.ErrClosed
+	}
+	defer view.Release()
+
+	if view.Size() > len(packet) {
+		return 0, errors.New("buffer is too small for the packet")
+	}
+	return view.Read(packet)
+}
+
+func (dev *device) Write(packet []byte) (int, error) {
+	if len(packet) == 0 {
+		return 0, nil
+	}
+
+	pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(packet)})
+	defer pkb.DecRef()
+
+	switch packet[0] >> 4 {
+	case 4:
+		dev.endpoint.InjectInbound(header.IPv4ProtocolNumber, pkb)
+	case 6:
+		dev.endpoint.InjectInbound(header.IPv6ProtocolNumber, pkb)
+	default:
+		return 0, errors.New("unknown IP version")
+	}
+	return len(packet), nil
+}
+
+// WriteNotify is called by the channel endpoint when the stack has an outbound packet.
+func (dev *device) WriteNotify() {
+	pkt := dev.endpoint.Read()
+	if pkt == nil {
+		return
+	}
+
+	view := pkt.ToView()
+	pkt.DecRef()
+
+	select {
+	case dev.incoming <- view:
+	case <-dev.closed:
+		view.Release()
+	}
+}
+
+func (dev *device) MTU() (int, error) {
+	return dev.mtu, nil
+}
+
+func (dev *device) Name() (string, error) {
+	return "netstack", nil
+}
+
+func (dev *device) Events() <-chan tun.Event {
+	return dev.events
+}
+
+func (dev *device) Close() error {
+	dev.once.Do(func() {
+		close(dev.closed)
+
+		dev.endpoint.RemoveNotify(dev.notify)
+		dev.stack.RemoveNIC(nicID)
+		dev.stack.Close()
+		dev.endpoint.Close()
+
+		dev.events <- tun.EventDown
+		close(dev.events)
+	})
+	return nil
+}
+
+func (n *Net) fullAddress(endpoint netip.AddrPort) (tcpip.FullAddress, tcpip.NetworkProtocolNumber) {
+	protocol := ipv6.ProtocolNumber
+	if endpoint.Addr().Is4() {
+		protocol = ipv4.ProtocolNumber
+	}
+
+	var addr tcpip.Address
+	if endpoint.Addr().IsValid() && !endpoint.Addr().IsUnspecified() {
+		addr = tcpip.AddrFromSlice(endpoint.Addr().AsSlice())
+	}
+	return tcpip.FullAddress{NIC: nicID, Addr: addr, Port: endpoint.Port()}, protocol
+}
+
+// DialTCP opens a TCP connection to the address through the tunnel.
+func (n *Net) DialTCP(ctx context.Context, addr netip.AddrPort) (*gonet.TCPConn, error) {
+	fa, protocol := n.fullAddress(addr)
+	return gonet.DialContextTCP(ctx, n.stack, fa, protocol)
+}
+
+// ListenTCP accepts TCP connections on the local address of the tunnel.
+func (n *Net) ListenTCP(addr netip.AddrPort) (*gonet.TCPListener, error) {
+	fa, protocol := n.fullAddress(addr)
+	return gonet.ListenTCP(n.stack, fa, protocol)
+}
+
+// DialUDP opens a UDP socket, either local or remote address may be left unspecified.
+func (n *Net) DialUDP(laddr, raddr netip.AddrPort) (*gonet.UDPConn, error) {
+	var lfa, rfa *tcpip.FullAddress
+	var protocol tcpip.NetworkProtocolNumber
+
+	if laddr.IsValid() || laddr.Port() > 0 {
+		var fa tcpip.FullAddress
+		fa, protocol = n.fullAddress(laddr)
+		lfa = &fa
+	}
+	if raddr.IsValid() || raddr.Port() > 0 {
+		var fa tcpip.FullAddress
+		fa, protocol = n.fullAddress(raddr)
+		rfa = &fa
+	}
+	return gonet.DialUDP(n.stack, lfa, rfa, protocol)
+}
+
+// ListenUDP opens a UDP socket bound to the local address.
+func (n *Net) ListenUDP(laddr netip.AddrPort) (*gonet.UDPConn, error) {
+	return n.DialUDP(laddr, netip.AddrPort{})
+}
+
+// Resolver returns a resolver sending DNS queries through the tunnel
+// to the first of the configured DNS servers.
+func (n *Net) Resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			if len(n.dnsServers) == 0 {
+				return nil, errors.New("no DNS servers configured")
+			}
+			server := netip.AddrPortFrom(n.dnsServers[0], dnsPort)
+
+			switch network {
+			case "udp", "udp4", "udp6":
+				return n.DialUDP(netip.AddrPort{}, server)
+			default:
+				return n.DialTCP(ctx, server)
+			}
+		},
+	}
+}
+
+// Dial connects to the address through the tunnel, resolving host names with Resolver.
+func (n *Net) Dial(network, address string) (net.Conn, error) {
+	return n.DialContext(context.Background(), network, address)
+}
+
+func (n *Net) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	addrs, err := n.resolve(ctx, network, address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	var lastErr error
+	for _, addr := range addrs {
+		var conn net.Conn
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+			conn, lastErr = n.DialTCP(ctx, addr)
+		default:
+			conn, lastErr = n.DialUDP(netip.AddrPort{}, addr)
+		}
+		if lastErr == nil {
+			return conn, nil
+		}
+	}
+	return nil, &net.OpError{Op: "dial", Net: network, Err: lastErr}
+}
+
+// Listen accepts TCP connections on the address, which must be an IP literal.
+func (n *Net) Listen(network, address string) (net.Listener, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	addr, err := parseListenAddress(address)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	return n.ListenTCP(addr)
+}
+
+func (n *Net) resolve(ctx context.Context, network, address string) ([]netip.AddrPort, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+
+	host, portName, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portName, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", portName)
+	}
+
+	var hosts []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		hosts = []netip.Addr{addr}
+	} else {
+		hosts, err = n.Resolver().LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var addrs []netip.AddrPort
+	for _, addr := range hosts {
+		addr = addr.Unmap()
+		switch {
+		case addr.Is4() && (!n.hasV4 || network[len(network)-1] == '6'):
+		case addr.Is6() && (!n.hasV6 || network[len(network)-1] == '4'):
+		default:
+			addrs = append(addrs, netip.AddrPortFrom(addr, uint16(port)))
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no suitable address found")
+	}
+	return addrs, nil
+}
+
+func parseListenAddress(address string) (netip.AddrPort, error) {
+	host, portName, err := net.SplitHostPort(address)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	port, err := strconv.ParseUint(portName, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid port %s", portName)
+	}
+	if host == "" {
+		return netip.AddrPortFrom(netip.Addr{}, uint16(port)), nil
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(addr, uint16(port)), nil
+}
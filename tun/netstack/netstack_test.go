@@ -0,0 +1,138 @@
+package netstack
+
+import (
+	"com.github.grambbledook/simple_vpn/internal/vpntest"
+	"com.github.grambbledook/simple_vpn/tun"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+)
+
+const testMTU = 1420
+
+func Test_Net_TCPThroughTunnel(t *testing.T) {
+	aliceAddr, bobAddr := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	alice, bob := vpntest.NewPeers(netip.PrefixFrom(aliceAddr, 32), netip.PrefixFrom(bobAddr, 32))
+
+	aliceTun, aliceNet, err := CreateNetTUN([]netip.Addr{aliceAddr}, nil, testMTU)
+	assert.Nil(t, err)
+	defer aliceTun.Close()
+	bobTun, bobNet, err := CreateNetTUN([]netip.Addr{bobAddr}, nil, testMTU)
+	assert.Nil(t, err)
+	defer bobTun.Close()
+
+	vpntest.Connect(t, alice, bob, aliceTun, bobTun)
+
+	listener, err := bobNet.Listen("tcp", "10.0.0.2:8080")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := aliceNet.DialContext(ctx, "tcp", "10.0.0.2:8080")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = conn.Write([]byte("hello through the tunnel"))
+	assert.Nil(t, err)
+
+	reply := make([]byte, len("hello through the tunnel"))
+	_, err = io.ReadFull(conn, reply)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello through the tunnel", string(reply))
+}
+
+func Test_Net_UDPThroughTunnel(t *testing.T) {
+	aliceAddr, bobAddr := netip.MustParseAddr("fd00::1"), netip.MustParseAddr("fd00::2")
+	alice, bob := vpntest.NewPeers(netip.PrefixFrom(aliceAddr, 128), netip.PrefixFrom(bobAddr, 128))
+
+	aliceTun, aliceNet, err := CreateNetTUN([]netip.Addr{aliceAddr}, nil, testMTU)
+	assert.Nil(t, err)
+	defer aliceTun.Close()
+	bobTun, bobNet, err := CreateNetTUN([]netip.Addr{bobAddr}, nil, testMTU)
+	assert.Nil(t, err)
+	defer bobTun.Close()
+
+	vpntest.Connect(t, alice, bob, aliceTun, bobTun)
+
+	server, err := bobNet.ListenUDP(netip.AddrPortFrom(bobAddr, 53))
+	assert.Nil(t, err)
+	defer server.Close()
+
+	client, err := aliceNet.DialUDP(netip.AddrPort{}, netip.AddrPortFrom(bobAddr, 53))
+	assert.Nil(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte("query"))
+	assert.Nil(t, err)
+
+	server.SetDeadline(time.Now().Add(10 * time.Second))
+	buffer := make([]byte, testMTU)
+	n, from, err := server.ReadFrom(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, "query", string(buffer[:n]))
+	assert.Equal(t, aliceAddr.String(), netip.MustParseAddrPort(from.String()).Addr().String())
+}
+
+func Test_Net_DialErrors(t *testing.T) {
+	device, n, err := CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.0.0.1")}, nil, testMTU)
+	assert.Nil(t, err)
+	defer device.Close()
+
+	_, err = n.Dial("unix", "10.0.0.2:80")
+	assert.NotNil(t, err)
+
+	_, err = n.Dial("tcp6", "[fd00::2]:80")
+	assert.NotNil(t, err, "the stack has no IPv6 address")
+
+	_, err = n.Dial("tcp", "example.com:80")
+	assert.NotNil(t, err, "no DNS servers to resolve the name")
+}
+
+func Test_Device_Close(t *testing.T) {
+	dev, n, err := CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.0.0.1")}, nil, testMTU)
+	assert.Nil(t, err)
+
+	// The stack keeps sending packets while the device is closed
+	conn, err := n.DialUDP(netip.AddrPort{}, netip.MustParseAddrPort("10.0.0.2:53"))
+	assert.Nil(t, err)
+	defer conn.Close()
+	go func() {
+		for {
+			if _, err := conn.Write([]byte("query")); err != nil {
+				return
+			}
+		}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, dev.Close())
+	assert.Nil(t, dev.Close(), "closing twice is harmless")
+	dev.(*device).WriteNotify()
+
+	_, err = dev.Read(make([]byte, testMTU))
+	assert.ErrorIs(t, err, os.ErrClosed)
+
+	var events []tun.Event
+	for event := range dev.Events() {
+		events = append(events, event)
+	}
+	assert.Equal(t, []tun.Event{tun.EventUp, tun.EventDown}, events)
+}
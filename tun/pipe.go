@@ -0,0 +1,98 @@
+package tun
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+const pipeQueueSize = 1024
+
+// pipe is one end of an in-memory pair of devices.
+// Packets written into one end are read from the other one.
+type pipe struct {
+	name   string
+	mtu    int
+	in     <-chan []byte
+	out    chan<- []byte
+	events chan Event
+	closed chan struct{}
+	once   *sync.Once
+	peer   *pipe
+}
+
+// NewPipe creates two connected in-memory devices, so that the tunnel
+// could be tested without a kernel TUN device: one end is given to the tunnel,
+// the other acts as the network stack on top of it.
+func NewPipe(name string, mtu int) (Device, Device) {
+	ab := make(chan []byte, pipeQueueSize)
+	ba := make(chan []byte, pipeQueueSize)
+	closed := make(chan struct{})
+	once := &sync.Once{}
+
+	a := &pipe{name: name, mtu: mtu, in: ba, out: ab, events: make(chan Event, 2), closed: closed, once: once}
+	b := &pipe{name: name, mtu: mtu, in: ab, out: ba, events: make(chan Event, 2), closed: closed, once: once}
+	a.peer, b.peer = b, a
+
+	a.events <- EventUp
+	b.events <- EventUp
+	return a, b
+}
+
+func (p *pipe) Read(packet []byte) (int, error) {
+	select {
+	case data := <-p.in:
+		if len(data) > len(packet) {
+			return 0, errors.New("buffer is too small for the packet")
+		}
+		return copy(packet, data), nil
+	case <-p.closed:
+		return 0, io.EOF
+	}
+}
+
+func (p *pipe) Write(packet []byte) (int, error) {
+	if len(packet) > p.mtu {
+		return 0, errors.New("packet exceeds the MTU")
+	}
+
+	data := make([]byte, len(packet))
+	copy(data, packet)
+
+	select {
+	case <-p.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	select {
+	case p.out <- data:
+		return len(packet), nil
+	case <-p.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (p *pipe) MTU() (int, error) {
+	return p.mtu, nil
+}
+
+func (p *pipe) Name() (string, error) {
+	return p.name, nil
+}
+
+func (p *pipe) Events() <-chan Event {
+	return p.events
+}
+
+// Close closes both ends of the pipe, each of them reports EventDown and closes its events.
+func (p *pipe) Close() error {
+	p.once.Do(func() {
+		close(p.closed)
+		for _, end := range []*pipe{p, p.peer} {
+			end.events <- EventDown
+			close(end.events)
+		}
+	})
+	return nil
+}
@@ -0,0 +1,83 @@
+package tun_test
+
+import (
+	"com.github.grambbledook/simple_vpn/internal/vpntest"
+	"com.github.grambbledook/simple_vpn/tun"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/netip"
+	"testing"
+)
+
+func Test_Pipe_ReadWrite(t *testing.T) {
+	tunnel, stack := tun.NewPipe("wg0", 1420)
+
+	assert.Equal(t, tun.EventUp, <-tunnel.Events())
+	name, err := tunnel.Name()
+	assert.Nil(t, err)
+	assert.Equal(t, "wg0", name)
+	mtu, err := stack.MTU()
+	assert.Nil(t, err)
+	assert.Equal(t, 1420, mtu)
+
+	packet := []byte("packet")
+	_, err = stack.Write(packet)
+	assert.Nil(t, err)
+	packet[0] = 'X'
+
+	buffer := make([]byte, mtu)
+	n, err := tunnel.Read(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("packet"), buffer[:n], "written packets are copied")
+
+	_, err = tunnel.Write(make([]byte, mtu+1))
+	assert.NotNil(t, err, "packets larger than MTU are rejected")
+
+	assert.Nil(t, stack.Close())
+	assert.Nil(t, tunnel.Close(), "closing twice is harmless")
+	_, err = tunnel.Read(buffer)
+	assert.Equal(t, io.EOF, err)
+	_, err = tunnel.Write(packet)
+	assert.NotNil(t, err)
+
+	// Both ends report the shutdown, like a native device
+	for _, end := range []tun.Device{tunnel, stack} {
+		var events []tun.Event
+		for event := range end.Events() {
+			events = append(events, event)
+		}
+		assert.Contains(t, events, tun.EventDown)
+	}
+}
+
+// Test_Pipe_Pipeline sends a packet from the network stack of one device
+// through encryption, routing and decryption to the network stack of the other one.
+func Test_Pipe_Pipeline(t *testing.T) {
+	aliceAddr, bobAddr := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	alice, bob := vpntest.NewPeers(netip.PrefixFrom(aliceAddr, 32), netip.PrefixFrom(bobAddr, 32))
+
+	aliceTun, aliceStack := tun.NewPipe("alice", 1420)
+	bobTun, bobStack := tun.NewPipe("bob", 1420)
+	defer aliceTun.Close()
+	defer bobTun.Close()
+
+	vpntest.Connect(t, alice, bob, aliceTun, bobTun)
+
+	buffer := make([]byte, 1420)
+
+	request := vpntest.IPv4Packet(aliceAddr, bobAddr, "ping")
+	_, err := aliceStack.Write(request)
+	assert.Nil(t, err)
+
+	n, err := bobStack.Read(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, request, buffer[:n])
+
+	response := vpntest.IPv4Packet(bobAddr, aliceAddr, "pong")
+	_, err = bobStack.Write(response)
+	assert.Nil(t, err)
+
+	n, err = aliceStack.Read(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, response, buffer[:n])
+}
@@ -0,0 +1,24 @@
+package tun
+
+// Event is a change of the device state reported through Device.Events.
+type Event int
+
+const (
+	EventUp Event = 1 << iota
+	EventDown
+	EventMTUUpdate
+)
+
+// Device is the interface between the tunnel and a network stack:
+// inner packets sent by the stack are read from the device,
+// and decrypted inner packets are written back into it.
+type Device interface {
+	// Read reads a single packet into the buffer, returning its size.
+	Read(packet []byte) (int, error)
+	// Write writes a single packet.
+	Write(packet []byte) (int, error)
+	MTU() (int, error)
+	Name() (string, error)
+	Events() <-chan Event
+	Close() error
+}
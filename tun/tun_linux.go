@@ -0,0 +1,124 @@
+package tun
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"os"
+	"sync"
+)
+
+const cloneDevicePath = "/dev/net/tun"
+
+// nativeTun is a kernel TUN device without the packet information header,
+// so that every read and write carries exactly one IP packet.
+type nativeTun struct {
+	file   *os.File
+	name   string
+	events chan Event
+	once   sync.Once
+}
+
+// CreateTUN creates a TUN interface with the given name and MTU.
+// Creating an interface requires CAP_NET_ADMIN.
+func CreateTUN(name string, mtu int) (Device, error) {
+	fd, err := unix.Open(cloneDevicePath, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	// Non-blocking mode lets the runtime poller interrupt reads on Close
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	tun := &nativeTun{
+		file:   os.NewFile(uintptr(fd), cloneDevicePath),
+		name:   ifr.Name(),
+		events: make(chan Event, 2),
+	}
+
+	if err := tun.setMTU(mtu); err != nil {
+		tun.Close()
+		return nil, err
+	}
+
+	tun.events <- EventUp
+	return tun, nil
+}
+
+func (tun *nativeTun) Read(packet []byte) (int, error) {
+	return tun.file.Read(packet)
+}
+
+func (tun *nativeTun) Write(packet []byte) (int, error) {
+	return tun.file.Write(packet)
+}
+
+func (tun *nativeTun) Name() (string, error) {
+	return tun.name, nil
+}
+
+func (tun *nativeTun) Events() <-chan Event {
+	return tun.events
+}
+
+func (tun *nativeTun) MTU() (int, error) {
+	ifr, err := unix.NewIfreq(tun.name)
+	if err != nil {
+		return 0, err
+	}
+
+	err = withControlSocket(func(fd int) error {
+		return unix.IoctlIfreq(fd, unix.SIOCGIFMTU, ifr)
+	})
+	return int(ifr.Uint32()), err
+}
+
+func (tun *nativeTun) setMTU(mtu int) error {
+	if mtu <= 0 {
+		return errors.New("invalid MTU")
+	}
+
+	ifr, err := unix.NewIfreq(tun.name)
+	if err != nil {
+		return err
+	}
+	ifr.SetUint32(uint32(mtu))
+
+	return withControlSocket(func(fd int) error {
+		return unix.IoctlIfreq(fd, unix.SIOCSIFMTU, ifr)
+	})
+}
+
+func (tun *nativeTun) Close() error {
+	var err error
+	tun.once.Do(func() {
+		err = tun.file.Close()
+		tun.events <- EventDown
+		close(tun.events)
+	})
+	return err
+}
+
+// withControlSocket runs the interface ioctl on a throwaway datagram socket.
+func withControlSocket(f func(fd int) error) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	return f(fd)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package tun
+
+import "errors"
+
+// CreateTUN is only implemented for Linux, use NewPipe elsewhere.
+func CreateTUN(name string, mtu int) (Device, error) {
+	return nil, errors.New("TUN devices are not supported on this platform")
+}
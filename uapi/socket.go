@@ -0,0 +1,48 @@
+package uapi
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// SocketDirectory is where the wg tool looks for the control sockets.
+const SocketDirectory = "/var/run/wireguard"
+
+// SocketPath returns the path of the control socket of the interface.
+func SocketPath(name string) string {
+	return filepath.Join(SocketDirectory, name+".sock")
+}
+
+// Listen creates the control socket at the path, replacing a stale one
+// left behind by a process which didn't shut down cleanly.
+func Listen(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, errors.New("control socket is already in use")
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	old := umask(0077)
+	listener, err := net.Listen("unix", path)
+	umask(old)
+	return listener, err
+}
+
+// Serve handles every connection to the listener in its own goroutine until the listener is closed.
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.Handle(conn)
+	}
+}
@@ -0,0 +1,345 @@
+// Package uapi implements the cross-platform userspace API of WireGuard,
+// so the device could be inspected and configured with the wg tool.
+//
+// See https://www.wireguard.com/xplatform/
+package uapi
+
+import (
+	"bufio"
+	"com.github.grambbledook/simple_vpn/protocol"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Bind is the UDP transport of the device, reconfigured by listen_port and fwmark.
+type Bind interface {
+	ListenPort() uint16
+	SetListenPort(port uint16) error
+	FwMark() uint32
+	SetFwMark(mark uint32) error
+}
+
+// Server answers get and set operations for a device.
+// OnPeerCreated is called for every peer added by a set operation, once its timers are running,
+// so the timer callbacks should be attached by Device.OnPeerAdded instead.
+type Server struct {
+	Device        *protocol.Device
+	Bind          Bind
+	OnPeerCreated func(*protocol.Tunnel)
+}
+
+// Error is reported to the client as a negated errno value.
+type Error struct {
+	Errno   syscall.Errno
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Message, e.Errno)
+}
+
+func errorf(errno syscall.Errno, format string, args ...any) error {
+	return &Error{Errno: errno, Message: fmt.Sprintf(format, args...)}
+}
+
+// Handle serves the operations of a single client until it disconnects.
+func (s *Server) Handle(conn io.ReadWriteCloser) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		op, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		switch op {
+		case "get=1\n":
+			// The request ends with an empty line, like a set operation
+			var next byte
+			if next, err = reader.ReadByte(); err != nil {
+				return
+			}
+			if next != '\n' {
+				err = errorf(syscall.EINVAL, "trailing character in get operation: %q", next)
+				break
+			}
+			err = s.Get(writer)
+		case "set=1\n":
+			err = s.Set(reader)
+		default:
+			return
+		}
+
+		var status *Error
+		switch {
+		case err == nil:
+			fmt.Fprintf(writer, "errno=0\n\n")
+		case errors.As(err, &status):
+			fmt.Fprintf(writer, "errno=%d\n\n", status.Errno)
+		default:
+			fmt.Fprintf(writer, "errno=%d\n\n", syscall.EIO)
+		}
+
+		if err := writer.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// Get writes the configuration and the state of the device, without the trailing errno.
+func (s *Server) Get(w io.Writer) error {
+	d := s.Device
+
+	var lines []string
+	add := func(key string, value any) {
+		lines = append(lines, fmt.Sprintf("%s=%v", key, value))
+	}
+
+	if local := d.Identity(); local.PrivateKey != (protocol.PrivateKey{}) {
+		add("private_key", hex.EncodeToString(local.PrivateKey[:]))
+	}
+	if s.Bind != nil {
+		if port := s.Bind.ListenPort(); port != 0 {
+			add("listen_port", port)
+		}
+		if mark := s.Bind.FwMark(); mark != 0 {
+			add("fwmark", mark)
+		}
+	}
+
+	for _, t := range d.Peers() {
+		t.Lock()
+		remote, endpoint, tx, rx := t.Remote, t.Endpoint, t.TxBytes, t.RxBytes
+		t.Unlock()
+
+		add("public_key", hex.EncodeToString(remote.PublicKey[:]))
+		add("preshared_key", hex.EncodeToString(remote.PresharedKey[:]))
+		add("protocol_version", 1)
+		if endpoint.IsValid() {
+			add("endpoint", endpoint)
+		}
+
+		var sec, nsec int64
+		if last := t.Timers.LastHandshake(); !last.IsZero() {
+			sec, nsec = last.Unix(), int64(last.Nanosecond())
+		}
+		add("last_handshake_time_sec", sec)
+		add("last_handshake_time_nsec", nsec)
+		add("tx_bytes", tx)
+		add("rx_bytes", rx)
+		add("persistent_keepalive_interval", int(t.Timers.PersistentKeepalive()/time.Second))
+
+		for _, prefix := range d.AllowedIPs.EntriesForPeer(t) {
+			add("allowed_ip", prefix)
+		}
+	}
+
+	for _, line := range lines {
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return errorf(syscall.EIO, "failed to write the response: %v", err)
+		}
+	}
+	return nil
+}
+
+// peerSetting is the peer being configured by the set operation,
+// nil tunnel means the rest of the section is ignored.
+type peerSetting struct {
+	tunnel  *protocol.Tunnel
+	created bool
+}
+
+// Set applies the key=value lines up to the first empty line.
+// Keys following a public_key line configure that peer.
+func (s *Server) Set(r *bufio.Reader) error {
+	var peer *peerSetting
+	var failed error
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return errorf(syscall.EIO, "failed to read the request: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return failed
+		}
+
+		// The rest of the request is consumed after an error, so the next operation is read correctly
+		if failed != nil {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			failed = errorf(syscall.EPROTO, "invalid line %q", line)
+			continue
+		}
+
+		if key == "public_key" {
+			peer, failed = s.selectPeer(value)
+			continue
+		}
+
+		if peer == nil {
+			failed = s.setDevice(key, value)
+		} else {
+			failed = s.setPeer(peer, key, value)
+		}
+	}
+}
+
+func (s *Server) setDevice(key, value string) error {
+	d := s.Device
+
+	switch key {
+	case "private_key":
+		var sk protocol.PrivateKey
+		if err := parseKey(sk[:], value); err != nil {
+			return err
+		}
+		d.SetPrivateKey(sk)
+	case "listen_port":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return errorf(syscall.EINVAL, "invalid listen_port %q", value)
+		}
+		if s.Bind == nil {
+			return errorf(syscall.EINVAL, "listen_port can't be changed")
+		}
+		if err := s.Bind.SetListenPort(uint16(port)); err != nil {
+			return errorf(syscall.EADDRINUSE, "failed to set listen_port: %v", err)
+		}
+	case "fwmark":
+		mark, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return errorf(syscall.EINVAL, "invalid fwmark %q", value)
+		}
+		if s.Bind == nil {
+			return errorf(syscall.EINVAL, "fwmark can't be changed")
+		}
+		if err := s.Bind.SetFwMark(uint32(mark)); err != nil {
+			return errorf(syscall.EINVAL, "failed to set fwmark: %v", err)
+		}
+	case "replace_peers":
+		if value != "true" {
+			return errorf(syscall.EINVAL, "invalid replace_peers %q", value)
+		}
+		for _, t := range d.Peers() {
+			d.RemovePeer(t.Remote.PublicKey)
+		}
+	default:
+		return errorf(syscall.EINVAL, "invalid device key %q", key)
+	}
+	return nil
+}
+
+func (s *Server) selectPeer(value string) (*peerSetting, error) {
+	var pk protocol.PublicKey
+	if err := parseKey(pk[:], value); err != nil {
+		return nil, err
+	}
+
+	// Configuring the local identity as a peer is silently ignored
+	if pk == s.Device.Identity().PublicKey {
+		return &peerSetting{}, nil
+	}
+
+	if t := s.Device.LookupPeer(pk); t != nil {
+		return &peerSetting{tunnel: t}, nil
+	}
+
+	t := s.Device.AddPeer(protocol.Peer{PublicKey: pk})
+	if s.OnPeerCreated != nil {
+		s.OnPeerCreated(t)
+	}
+	return &peerSetting{tunnel: t, created: true}, nil
+}
+
+func (s *Server) setPeer(peer *peerSetting, key, value string) error {
+	d, t := s.Device, peer.tunnel
+	if t == nil {
+		return nil
+	}
+
+	switch key {
+	case "update_only":
+		if value != "true" {
+			return errorf(syscall.EINVAL, "invalid update_only %q", value)
+		}
+		if peer.created {
+			d.RemovePeer(t.Remote.PublicKey)
+			peer.tunnel = nil
+		}
+	case "remove":
+		if value != "true" {
+			return errorf(syscall.EINVAL, "invalid remove %q", value)
+		}
+		d.RemovePeer(t.Remote.PublicKey)
+		peer.tunnel = nil
+	case "preshared_key":
+		var psk protocol.PresharedKey
+		if err := parseKey(psk[:], value); err != nil {
+			return err
+		}
+		t.Lock()
+		t.Remote.PresharedKey = psk
+		t.Unlock()
+	case "endpoint":
+		endpoint, err := netip.ParseAddrPort(value)
+		if err != nil {
+			resolved, err := net.ResolveUDPAddr("udp", value)
+			if err != nil {
+				return errorf(syscall.EINVAL, "invalid endpoint %q", value)
+			}
+			endpoint = resolved.AddrPort()
+		}
+		t.Lock()
+		t.Endpoint = netip.AddrPortFrom(endpoint.Addr().Unmap(), endpoint.Port())
+		t.Unlock()
+	case "persistent_keepalive_interval":
+		seconds, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return errorf(syscall.EINVAL, "invalid persistent_keepalive_interval %q", value)
+		}
+		t.Timers.SetPersistentKeepalive(time.Duration(seconds) * time.Second)
+	case "replace_allowed_ips":
+		if value != "true" {
+			return errorf(syscall.EINVAL, "invalid replace_allowed_ips %q", value)
+		}
+		d.AllowedIPs.RemoveByPeer(t)
+	case "allowed_ip":
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return errorf(syscall.EINVAL, "invalid allowed_ip %q", value)
+		}
+		d.AllowedIPs.Insert(prefix, t)
+	case "protocol_version":
+		if value != "1" {
+			return errorf(syscall.EINVAL, "unsupported protocol_version %q", value)
+		}
+	default:
+		return errorf(syscall.EINVAL, "invalid peer key %q", key)
+	}
+	return nil
+}
+
+func parseKey(dst []byte, value string) error {
+	if hex.DecodedLen(len(value)) != len(dst) {
+		return errorf(syscall.EINVAL, "invalid key length")
+	}
+	if _, err := hex.Decode(dst, []byte(value)); err != nil {
+		return errorf(syscall.EINVAL, "invalid key %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package uapi
+
+import (
+	"bufio"
+	"com.github.grambbledook/simple_vpn/protocol"
+	"encoding/hex"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type fakeBind struct {
+	port uint16
+	mark uint32
+}
+
+func (b *fakeBind) ListenPort() uint16 { return b.port }
+
+func (b *fakeBind) SetListenPort(port uint16) error {
+	if port == 1 {
+		return errors.New("address already in use")
+	}
+	b.port = port
+	return nil
+}
+
+func (b *fakeBind) FwMark() uint32 { return b.mark }
+
+func (b *fakeBind) SetFwMark(mark uint32) error {
+	b.mark = mark
+	return nil
+}
+
+func newServer() *Server {
+	sk := protocol.NewPrivateKey()
+	return &Server{
+		Device: protocol.NewDevice(sk),
+		Bind:   &fakeBind{port: 51820},
+	}
+}
+
+func newKey() (protocol.PrivateKey, protocol.PublicKey) {
+	sk := protocol.NewPrivateKey()
+	return sk, sk.PublicKey()
+}
+
+func set(s *Server, request string) error {
+	return s.Set(bufio.NewReader(strings.NewReader(request + "\n")))
+}
+
+func get(t *testing.T, s *Server) []string {
+	var response strings.Builder
+	assert.Nil(t, s.Get(&response))
+	return strings.Split(strings.TrimSuffix(response.String(), "\n"), "\n")
+}
+
+func Test_Server_SetAndGet(t *testing.T) {
+	s := newServer()
+	sk, pk := newKey()
+	_, peer := newKey()
+
+	var psk protocol.PresharedKey
+	psk[0] = 1
+
+	created := 0
+	s.OnPeerCreated = func(*protocol.Tunnel) { created++ }
+
+	err := set(s, strings.Join([]string{
+		"private_key=" + hex.EncodeToString(sk[:]),
+		"listen_port=12912",
+		"fwmark=7",
+		"public_key=" + hex.EncodeToString(peer[:]),
+		"preshared_key=" + hex.EncodeToString(psk[:]),
+		"endpoint=[::ffff:192.0.2.1]:51820",
+		"persistent_keepalive_interval=25",
+		"replace_allowed_ips=true",
+		"allowed_ip=10.0.0.0/24",
+		"allowed_ip=fd00::1/128",
+		"protocol_version=1",
+		"",
+	}, "\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, created)
+
+	assert.Equal(t, pk, s.Device.Identity().PublicKey)
+
+	tunnel := s.Device.LookupPeer(peer)
+	assert.NotNil(t, tunnel)
+	assert.Equal(t, psk, tunnel.Remote.PresharedKey)
+	assert.Equal(t, netip.MustParseAddrPort("192.0.2.1:51820"), tunnel.Endpoint)
+	assert.Equal(t, 25*time.Second, tunnel.Timers.PersistentKeepalive())
+	assert.Equal(t, tunnel, s.Device.AllowedIPs.Lookup(netip.MustParseAddr("10.0.0.7")))
+
+	assert.Equal(t, []string{
+		"private_key=" + hex.EncodeToString(sk[:]),
+		"listen_port=12912",
+		"fwmark=7",
+		"public_key=" + hex.EncodeToString(peer[:]),
+		"preshared_key=" + hex.EncodeToString(psk[:]),
+		"protocol_version=1",
+		"endpoint=192.0.2.1:51820",
+		"last_handshake_time_sec=0",
+		"last_handshake_time_nsec=0",
+		"tx_bytes=0",
+		"rx_bytes=0",
+		"persistent_keepalive_interval=25",
+		"allowed_ip=10.0.0.0/24",
+		"allowed_ip=fd00::1/128",
+	}, get(t, s))
+}
+
+func Test_Server_UpdateOnlyAndRemove(t *testing.T) {
+	s := newServer()
+	_, first := newKey()
+	_, second := newKey()
+
+	err := set(s, "public_key="+hex.EncodeToString(first[:])+"\nupdate_only=true\nallowed_ip=10.0.0.1/32\n")
+	assert.Nil(t, err)
+	assert.Empty(t, s.Device.Peers(), "update_only doesn't create peers")
+	assert.Nil(t, s.Device.AllowedIPs.Lookup(netip.MustParseAddr("10.0.0.1")))
+
+	err = set(s, "public_key="+hex.EncodeToString(first[:])+"\npublic_key="+hex.EncodeToString(second[:])+"\n")
+	assert.Nil(t, err)
+	assert.Len(t, s.Device.Peers(), 2)
+
+	err = set(s, "public_key="+hex.EncodeToString(first[:])+"\nremove=true\n")
+	assert.Nil(t, err)
+	assert.Nil(t, s.Device.LookupPeer(first))
+	assert.NotNil(t, s.Device.LookupPeer(second))
+
+	err = set(s, "replace_peers=true\npublic_key="+hex.EncodeToString(first[:])+"\n")
+	assert.Nil(t, err)
+	assert.NotNil(t, s.Device.LookupPeer(first))
+	assert.Nil(t, s.Device.LookupPeer(second), "replace_peers removes the peers not listed")
+}
+
+func Test_Server_SetErrors(t *testing.T) {
+	_, pk := newKey()
+	peer := "public_key=" + hex.EncodeToString(pk[:]) + "\n"
+
+	tests := []struct {
+		name    string
+		request string
+		errno   syscall.Errno
+	}{
+		{"missing separator", "listen_port\n", syscall.EPROTO},
+		{"unknown device key", "colour=blue\n", syscall.EINVAL},
+		{"invalid private key", "private_key=abcd\n", syscall.EINVAL},
+		{"invalid port", "listen_port=70000\n", syscall.EINVAL},
+		{"port in use", "listen_port=1\n", syscall.EADDRINUSE},
+		{"invalid public key", "public_key=not-hex-not-hex-not-hex-not-hex-not-hex-not-hex-not-he\n", syscall.EINVAL},
+		{"unknown peer key", peer + "colour=blue\n", syscall.EINVAL},
+		{"invalid allowed ip", peer + "allowed_ip=10.0.0.1\n", syscall.EINVAL},
+		{"invalid endpoint", peer + "endpoint=nowhere\n", syscall.EINVAL},
+		{"invalid keepalive", peer + "persistent_keepalive_interval=-1\n", syscall.EINVAL},
+		{"unsupported version", peer + "protocol_version=2\n", syscall.EINVAL},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := set(newServer(), test.request)
+
+			var uapiErr *Error
+			if assert.True(t, errors.As(err, &uapiErr), "unexpected error %v", err) {
+				assert.Equal(t, test.errno, uapiErr.Errno)
+			}
+		})
+	}
+}
+
+func Test_Server_Socket(t *testing.T) {
+	s := newServer()
+	_, peer := newKey()
+
+	path := filepath.Join(t.TempDir(), "wg0.sock")
+	listener, err := Listen(path)
+	assert.Nil(t, err)
+	defer listener.Close()
+	go s.Serve(listener)
+
+	_, err = Listen(path)
+	assert.NotNil(t, err, "the socket is in use")
+
+	conn, err := net.Dial("unix", path)
+	assert.Nil(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	readResponse := func() []string {
+		var lines []string
+		for {
+			line, err := reader.ReadString('\n')
+			assert.Nil(t, err)
+			if line == "\n" {
+				return lines
+			}
+			lines = append(lines, strings.TrimSuffix(line, "\n"))
+		}
+	}
+
+	_, err = conn.Write([]byte("set=1\npublic_key=" + hex.EncodeToString(peer[:]) + "\ncolour=blue\nallowed_ip=10.0.0.1/32\n\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"errno=22"}, readResponse())
+
+	_, err = conn.Write([]byte("set=1\npublic_key=" + hex.EncodeToString(peer[:]) + "\nallowed_ip=10.0.0.1/32\n\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"errno=0"}, readResponse())
+
+	// Several get operations are served on the same connection
+	for i := 0; i < 2; i++ {
+		_, err = conn.Write([]byte("get=1\n\n"))
+		assert.Nil(t, err)
+		response := readResponse()
+		assert.Contains(t, response, "listen_port=51820")
+		assert.Contains(t, response, "public_key="+hex.EncodeToString(peer[:]))
+		assert.Contains(t, response, "allowed_ip=10.0.0.1/32")
+		assert.Equal(t, "errno=0", response[len(response)-1])
+	}
+
+	_, err = conn.Write([]byte("get=1\nx"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"errno=22"}, readResponse())
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package uapi
+
+func umask(mask int) int {
+	return mask
+}
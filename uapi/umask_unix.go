@@ -0,0 +1,9 @@
+//go:build unix
+
+package uapi
+
+import "syscall"
+
+func umask(mask int) int {
+	return syscall.Umask(mask)
+}
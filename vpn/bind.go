@@ -0,0 +1,72 @@
+package vpn
+
+// ListenPort is the port the bind is open on, zero until the interface is up.
+func (i *Interface) ListenPort() uint16 {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.port
+}
+
+// SetListenPort reopens the bind on the port, the previous port is restored if the new one can't be used.
+// A receiver is started for every socket of the bind, the receivers of a closed bind return
+// once their ReceiveFunc fails with net.ErrClosed.
+func (i *Interface) SetListenPort(port uint16) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.open && port == i.port {
+		return nil
+	}
+
+	if i.open {
+		i.Bind.Close()
+		i.open = false
+	}
+
+	err := i.openLocked(port)
+	if err != nil && i.port != 0 {
+		if restoreErr := i.openLocked(i.port); restoreErr != nil {
+			return restoreErr
+		}
+	}
+	return err
+}
+
+func (i *Interface) openLocked(port uint16) error {
+	fns, actual, err := i.Bind.Open(port)
+	if err != nil {
+		return err
+	}
+	if i.mark != 0 {
+		if err := i.Bind.SetMark(i.mark); err != nil {
+			i.Bind.Close()
+			return err
+		}
+	}
+
+	i.open = true
+	i.port = actual
+	for _, fn := range fns {
+		go i.receiveMessages(fn)
+	}
+	return nil
+}
+
+func (i *Interface) FwMark() uint32 {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.mark
+}
+
+func (i *Interface) SetFwMark(mark uint32) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if err := i.Bind.SetMark(mark); err != nil {
+		return err
+	}
+	i.mark = mark
+	return nil
+}
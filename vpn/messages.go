@@ -0,0 +1,151 @@
+package vpn
+
+import (
+	"com.github.grambbledook/simple_vpn/protocol"
+	"errors"
+	"net/netip"
+)
+
+// checkHandshakeMACs reports whether a handshake message may be processed,
+// answering with a cookie reply when the device is under load.
+func (i *Interface) checkHandshakeMACs(msg []byte, sender uint32, remoteAddr netip.AddrPort) bool {
+	reply, err := i.Device.CheckHandshakeMACs(msg, sender, remoteAddr)
+	if reply != nil {
+		if err := i.writeTo(reply.ToBytes(), remoteAddr); err != nil {
+			i.logger().Warn("failed to send a cookie reply", "endpoint", remoteAddr, "error", err)
+		} else {
+			i.Device.Stats.CookieRepliesSent.Add(1)
+		}
+	}
+	if err != nil {
+		i.logger().Debug("handshake message dropped", "endpoint", remoteAddr, "error", err)
+		return false
+	}
+	return true
+}
+
+// SendInitiation starts a new handshake with the peer at its configured endpoint.
+// Retransmissions are driven by the peer timers through the same function.
+func (i *Interface) SendInitiation(tunnel *protocol.Tunnel) {
+	tunnel.Lock()
+	endpoint := tunnel.Endpoint
+	if !endpoint.IsValid() {
+		tunnel.Unlock()
+		return
+	}
+
+	message, err := tunnel.InitiateHandshake()
+	if err != nil {
+		tunnel.Unlock()
+		tunnel.Logger.Warn("failed to create a handshake initiation", "error", err)
+		return
+	}
+	bytes := message.ToBytes()
+	tunnel.Stamper.Stamp(bytes)
+	tunnel.Unlock()
+
+	tunnel.Logger.Debug("sending handshake initiation", "endpoint", endpoint)
+	if err := i.writeTo(bytes, endpoint); err != nil {
+		tunnel.Logger.Warn("failed to send a handshake initiation", "endpoint", endpoint, "error", err)
+	}
+}
+
+func (i *Interface) sendKeepalive(tunnel *protocol.Tunnel) {
+	tunnel.Lock()
+	endpoint := tunnel.Endpoint
+	if !endpoint.IsValid() {
+		tunnel.Unlock()
+		return
+	}
+
+	message, err := tunnel.CreateKeepaliveMessage()
+	tunnel.Unlock()
+	if errors.Is(err, protocol.ErrNoSession) {
+		tunnel.Logger.Debug("keepalive postponed until the session is established")
+		return
+	}
+	if err != nil {
+		tunnel.Logger.Warn("failed to create a keepalive", "error", err)
+		return
+	}
+
+	bytes := message.ToBytes()
+	if err := i.writeTo(bytes, endpoint); err != nil {
+		tunnel.Logger.Warn("failed to send a keepalive", "endpoint", endpoint, "error", err)
+		return
+	}
+
+	tunnel.Lock()
+	tunnel.CountSent(len(bytes))
+	tunnel.Unlock()
+}
+
+// handleMessage processes a single datagram received from remoteAddr.
+// Transport messages are handed to the pipeline by the receiver, which only sends the packets staged by the pipeline.
+func (i *Interface) handleMessage(data []byte, remoteAddr netip.AddrPort) {
+	parsed, err := protocol.ParseMessage(data)
+	if err != nil {
+		i.logger().Debug("invalid message dropped", "size", len(data), "endpoint", remoteAddr, "error", err)
+		return
+	}
+
+	switch message := parsed.(type) {
+	case *protocol.MessageHandshakeInit:
+		if !i.checkHandshakeMACs(data, message.Sender, remoteAddr) {
+			return
+		}
+
+		tunnel, err := i.Device.ProcessInitiateHandshakeMessage(*message, remoteAddr)
+		if err != nil {
+			i.logger().Debug("handshake initiation dropped", "endpoint", remoteAddr, "error", err)
+			return
+		}
+		tunnel.Lock()
+		response, err := tunnel.CreateInitiateHandshakeResponse()
+		if err != nil {
+			tunnel.Unlock()
+			tunnel.Logger.Warn("failed to create a handshake response", "error", err)
+			return
+		}
+		bytes := response.ToBytes()
+		tunnel.Stamper.Stamp(bytes)
+
+		if err = i.writeTo(bytes, remoteAddr); err != nil {
+			tunnel.Logger.Warn("failed to send a handshake response", "endpoint", remoteAddr, "error", err)
+		}
+
+		if err := tunnel.BeginSymmetricSession(); err != nil {
+			tunnel.Logger.Warn("failed to derive transport keys", "error", err)
+		}
+		tunnel.Unlock()
+
+	case *protocol.MessageHandshakeResponse:
+		if !i.checkHandshakeMACs(data, message.Sender, remoteAddr) {
+			return
+		}
+
+		tunnel, err := i.Device.ProcessInitiateHandshakeResponseMessage(*message, remoteAddr)
+		if err != nil {
+			i.logger().Debug("handshake response dropped", "endpoint", remoteAddr, "error", err)
+			return
+		}
+
+		tunnel.Lock()
+		err = tunnel.BeginSymmetricSession()
+		tunnel.Unlock()
+		if err != nil {
+			tunnel.Logger.Warn("failed to derive transport keys", "error", err)
+			return
+		}
+
+		// The responder can't send anything until it receives the first transport message
+		tunnel.Logger.Info("session established", "endpoint", remoteAddr)
+		i.sendKeepalive(tunnel)
+		i.pipeline.SendStaged(tunnel)
+
+	case *protocol.MessageHandshakeCookie:
+		if _, err := i.Device.ProcessHandshakeCookieMessage(*message); err != nil {
+			i.logger().Debug("cookie reply dropped", "endpoint", remoteAddr, "error", err)
+		}
+	}
+}
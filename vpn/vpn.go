@@ -0,0 +1,173 @@
+// Package vpn runs a device as a network interface: the packets of a TUN device are forwarded
+// through the transport pipeline, and the messages of the device are exchanged with its peers over a bind.
+package vpn
+
+import (
+	"com.github.grambbledook/simple_vpn/conn"
+	"com.github.grambbledook/simple_vpn/protocol"
+	"com.github.grambbledook/simple_vpn/tun"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// Interface connects a device to its TUN device and to the network through Bind.
+// The timers of the peers are attached by SetupPeer, which is meant to be called from Device.OnPeerAdded,
+// so an Interface is created before the peers are added and brought up once they are configured.
+//
+// Interface is also the uapi.Bind of the device: changing the listen port reopens the bind on it.
+type Interface struct {
+	Device *protocol.Device
+	TUN    tun.Device
+	Bind   conn.Bind
+
+	pipeline  *protocol.Pipeline
+	forwarder *tun.Forwarder
+
+	mu   sync.RWMutex
+	open bool
+	port uint16
+	mark uint32
+}
+
+// Up starts the pipeline, opens the bind on the port and forwards the packets read from the TUN device.
+func (i *Interface) Up(port uint16) error {
+	i.pipeline = &protocol.Pipeline{
+		Device:    i.Device,
+		OnSend:    i.send,
+		OnReceive: i.receive,
+		OnDrop: func(tunnel *protocol.Tunnel, err error) {
+			tunnel.Logger.Debug("transport message dropped", "error", err)
+		},
+	}
+	i.forwarder = &tun.Forwarder{
+		Device:   i.TUN,
+		Pipeline: i.pipeline,
+		OnDrop: func(err error) {
+			i.logger().Debug("packet dropped", "error", err)
+		},
+	}
+
+	i.pipeline.Start()
+	if err := i.SetListenPort(port); err != nil {
+		i.pipeline.Stop()
+		return err
+	}
+
+	go func() {
+		if err := i.forwarder.Run(); err != nil {
+			i.logger().Error("failed to read from the TUN device", "error", err)
+		}
+	}()
+	return nil
+}
+
+// Close closes the bind and the TUN device, and stops the pipeline once the queued messages are delivered.
+func (i *Interface) Close() error {
+	i.mu.Lock()
+	i.open = false
+	err := i.Bind.Close()
+	i.mu.Unlock()
+
+	if tunErr := i.TUN.Close(); err == nil {
+		err = tunErr
+	}
+	if i.pipeline != nil {
+		i.pipeline.Stop()
+	}
+	return err
+}
+
+// SetupPeer attaches the timers of the tunnel to the interface.
+func (i *Interface) SetupPeer(tunnel *protocol.Tunnel) {
+	// Timer callbacks must not block on the tunnel, so the messages are sent asynchronously
+	tunnel.Timers.OnHandshake = func() { go i.SendInitiation(tunnel) }
+	tunnel.Timers.OnKeepalive = func() { go i.sendKeepalive(tunnel) }
+}
+
+func (i *Interface) logger() *slog.Logger {
+	if i.Device.Logger != nil {
+		return i.Device.Logger
+	}
+	return discardLogger
+}
+
+func (i *Interface) writeTo(data []byte, endpoint netip.AddrPort) error {
+	return i.Bind.Send([][]byte{data}, endpoint)
+}
+
+// send writes the datagrams encrypted by the pipeline to the endpoint of their peer,
+// the bind coalesces them when the socket supports segmentation offload.
+func (i *Interface) send(tunnel *protocol.Tunnel, datagrams [][]byte) error {
+	tunnel.Lock()
+	endpoint := tunnel.Endpoint
+	tunnel.Unlock()
+
+	if !endpoint.IsValid() {
+		return errors.New("peer has no endpoint")
+	}
+	return i.Bind.Send(datagrams, endpoint)
+}
+
+// receive writes a packet decrypted by the pipeline into the TUN device.
+func (i *Interface) receive(tunnel *protocol.Tunnel, packet []byte, src netip.AddrPort) {
+	if len(packet) == 0 {
+		tunnel.Logger.Debug("keepalive received", "endpoint", src)
+		return
+	}
+	tunnel.Logger.Debug("packet received", "size", len(packet), "endpoint", src)
+	i.forwarder.Receive(tunnel, packet, src)
+}
+
+// receiveMessages reads the datagrams of a socket of the bind until it is closed:
+// transport messages are handed to the pipeline, and handshake messages are processed right away.
+func (i *Interface) receiveMessages(receive conn.ReceiveFunc) {
+	batch := i.Bind.BatchSize()
+	buffers := make([]*protocol.MessageBuffer, batch)
+	bufs := make([][]byte, batch)
+	for j := range buffers {
+		buffers[j] = i.pipeline.Buffers.Get()
+		bufs[j] = buffers[j][:]
+	}
+	sizes := make([]int, batch)
+	endpoints := make([]netip.AddrPort, batch)
+	defer func() {
+		for _, buffer := range buffers {
+			i.pipeline.Buffers.Put(buffer)
+		}
+	}()
+
+	for {
+		n, err := receive(bufs, sizes, endpoints)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			i.logger().Warn("failed to read from the socket", "error", err)
+			continue
+		}
+
+		for j := 0; j < n; j++ {
+			if sizes[j] == 0 {
+				continue
+			}
+
+			if buffers[j][0] == protocol.TransportType {
+				// The pipeline decrypts the message in its buffer, which is replaced with a new one
+				if err := i.pipeline.Decrypt(buffers[j], sizes[j], endpoints[j]); err != nil {
+					i.logger().Debug("transport message dropped", "endpoint", endpoints[j], "error", err)
+				}
+				buffers[j] = i.pipeline.Buffers.Get()
+				bufs[j] = buffers[j][:]
+				continue
+			}
+
+			i.handleMessage(buffers[j][:sizes[j]], endpoints[j])
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package vpn
+
+import (
+	"com.github.grambbledook/simple_vpn/conn"
+	"com.github.grambbledook/simple_vpn/internal/vpntest"
+	"com.github.grambbledook/simple_vpn/protocol"
+	"com.github.grambbledook/simple_vpn/tun"
+	"github.com/stretchr/testify/assert"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+const testMTU = 1420
+
+// startInterface brings the device up on a pipe TUN device and a bind on a random port,
+// the other end of the pipe plays the network stack of the host.
+func startInterface(t *testing.T, device *protocol.Device, name string) (*Interface, tun.Device) {
+	tunDevice, stack := tun.NewPipe(name, testMTU)
+	i := &Interface{Device: device, TUN: tunDevice, Bind: conn.NewStdNetBind()}
+	for _, tunnel := range device.Peers() {
+		i.SetupPeer(tunnel)
+	}
+
+	assert.Nil(t, i.Up(0))
+	t.Cleanup(func() { i.Close() })
+	return i, stack
+}
+
+func readPacket(t *testing.T, stack tun.Device) []byte {
+	read := make(chan []byte, 1)
+	go func() {
+		buffer := make([]byte, testMTU)
+		if n, err := stack.Read(buffer); err == nil {
+			read <- buffer[:n]
+		}
+	}()
+
+	select {
+	case packet := <-read:
+		return packet
+	case <-time.After(5 * time.Second):
+		t.Error("no packet came out of the tunnel")
+		return nil
+	}
+}
+
+// Test_Interface_Forwarding sends packets between the network stacks of two interfaces,
+// the first packet waits for the handshake it starts.
+func Test_Interface_Forwarding(t *testing.T) {
+	aliceAddr, bobAddr := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	alice, bob := vpntest.NewPeers(netip.PrefixFrom(aliceAddr, 32), netip.PrefixFrom(bobAddr, 32))
+	toBob := alice.LookupPeer(bob.Local.PublicKey)
+
+	_, aliceStack := startInterface(t, alice, "alice")
+	bobInterface, bobStack := startInterface(t, bob, "bob")
+
+	// Bob learns the endpoint of Alice from her handshake initiation
+	toBob.Lock()
+	toBob.Endpoint = netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), bobInterface.ListenPort())
+	toBob.Unlock()
+
+	request := vpntest.IPv4Packet(aliceAddr, bobAddr, "ping")
+	_, err := aliceStack.Write(request)
+	assert.Nil(t, err)
+	assert.Equal(t, request, readPacket(t, bobStack))
+
+	response := vpntest.IPv4Packet(bobAddr, aliceAddr, "pong")
+	_, err = bobStack.Write(response)
+	assert.Nil(t, err)
+	assert.Equal(t, response, readPacket(t, aliceStack))
+
+	toBob.Lock()
+	defer toBob.Unlock()
+	assert.Equal(t, uint64(2), toBob.TxPackets, "the keepalive confirming the session and the request")
+	assert.Equal(t, uint64(1), toBob.RxPackets)
+}
+
+func Test_Interface_SetListenPort(t *testing.T) {
+	alice, _ := vpntest.NewPeers(netip.MustParsePrefix("10.0.0.1/32"), netip.MustParsePrefix("10.0.0.2/32"))
+	i, _ := startInterface(t, alice, "alice")
+	port := i.ListenPort()
+	assert.NotZero(t, port)
+
+	taken, _ := startInterface(t, protocol.NewDevice(protocol.NewPrivateKey()), "taken")
+	assert.NotNil(t, i.SetListenPort(taken.ListenPort()))
+	assert.Equal(t, port, i.ListenPort(), "the previous port is restored")
+}